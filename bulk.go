@@ -0,0 +1,321 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	OversizeSingle = "single"
+	OversizeReject = "reject"
+)
+
+const (
+	itemOK uint8 = iota + 1
+	itemRetry
+	itemFail
+)
+
+var errNoClient = errors.New("elastic client not ready")
+
+// 可重试的错误类型 其余均视为永久失败
+var retryable = map[string]bool{
+	"es_rejected_execution_exception":         true,
+	"unavailable_shards_exception":            true,
+	"process_cluster_event_timeout_exception": true,
+	"timeout_exception":                       true,
+	"receive_timeout_transport_exception":     true,
+	"node_not_connected_exception":            true,
+	"no_shard_available_action_exception":     true,
+}
+
+func retryStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		http.StatusRequestTimeout:
+		return true
+	}
+	return false
+}
+
+// duplicate create遇到已存在的文档 部分成功的bulk重试或spool回放时出现 文档已经写入
+func duplicate(d *doc, item *elastic.BulkResponseItem) bool {
+	return d.op == OpCreate && item != nil && item.Status == http.StatusConflict &&
+		item.Error != nil && item.Error.Type == "version_conflict_engine_exception"
+}
+
+func classify(d *doc, item *elastic.BulkResponseItem) uint8 {
+	if item == nil {
+		return itemOK
+	}
+
+	if item.Status >= 200 && item.Status < 300 && item.Error == nil {
+		return itemOK
+	}
+
+	//删除不存在的文档
+	if item.Status == http.StatusNotFound && item.Error == nil && item.Result == "not_found" {
+		return itemOK
+	}
+
+	if duplicate(d, item) {
+		return itemOK
+	}
+
+	if retryStatus(item.Status) {
+		return itemRetry
+	}
+
+	if item.Error != nil && retryable[item.Error.Type] {
+		return itemRetry
+	}
+
+	return itemFail
+}
+
+// classifyErr 整个bulk请求失败时的分类
+func classifyErr(err error) uint8 {
+	if err == nil {
+		return itemOK
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return itemRetry
+	}
+
+	if errors.Is(err, errNoClient) || elastic.IsConnErr(err) || elastic.IsTimeout(err) {
+		return itemRetry
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return itemRetry
+	}
+
+	var ee *elastic.Error
+	if errors.As(err, &ee) && retryStatus(ee.Status) {
+		return itemRetry
+	}
+
+	return itemFail
+}
+
+func bulkItem(rsp *elastic.BulkResponse, i int) *elastic.BulkResponseItem {
+	if rsp == nil || i >= len(rsp.Items) {
+		return nil
+	}
+
+	for _, item := range rsp.Items[i] {
+		return item
+	}
+	return nil
+}
+
+type failure struct {
+	doc    *doc
+	status int
+	kind   string
+	reason string
+}
+
+func newFailure(d *doc, item *elastic.BulkResponseItem) *failure {
+	f := &failure{doc: d}
+	if item == nil {
+		return f
+	}
+
+	f.status = item.Status
+	if item.Error != nil {
+		f.kind = item.Error.Type
+		f.reason = item.Error.Reason
+	}
+	return f
+}
+
+func newFailureE(d *doc, err error) *failure {
+	f := &failure{doc: d, kind: "request_error", reason: err.Error()}
+
+	var ee *elastic.Error
+	if errors.As(err, &ee) {
+		f.status = ee.Status
+		if ee.Details != nil {
+			f.kind = ee.Details.Type
+			f.reason = ee.Details.Reason
+		}
+	}
+	return f
+}
+
+func (f *failure) String() string                         { return auxlib.B2S(f.Byte()) }
+func (f *failure) Type() lua.LValueType                   { return lua.LTObject }
+func (f *failure) AssertFloat64() (float64, bool)         { return 0, false }
+func (f *failure) AssertString() (string, bool)           { return "", false }
+func (f *failure) AssertFunction() (*lua.LFunction, bool) { return nil, false }
+func (f *failure) Peek() lua.LValue                       { return f }
+
+func (f *failure) Byte() []byte {
+	chunk, _ := json.Marshal(f.doc.data)
+	return chunk
+}
+
+func (f *failure) Index(L *lua.LState, key string) lua.LValue {
+	switch key {
+	case "index":
+		return lua.S2L(f.doc.index)
+	case "status":
+		return lua.LInt(f.status)
+	case "type":
+		return lua.S2L(f.kind)
+	case "reason":
+		return lua.S2L(f.reason)
+	case "attempt":
+		return lua.LInt(f.doc.attempt)
+	case "raw":
+		return lua.S2L(f.String())
+	}
+	return lua.LNil
+}
+
+// review 逐条检查bulk返回结果 返回需要重发的文档
+func (c *Client) review(v []*doc, rsp *elastic.BulkResponse) []*doc {
+	var retry []*doc
+
+	for i, d := range v {
+		item := bulkItem(rsp, i)
+		switch classify(d, item) {
+		case itemOK:
+			if duplicate(d, item) {
+				atomic.AddUint64(&c.duplicated, 1)
+			}
+			atomic.AddUint64(&c.succeed, 1)
+			atomic.AddUint64(&c.byIndex(d.index).sent, 1)
+		case itemRetry:
+			d.status = item.Status
+			if d.attempt++; d.attempt > c.cfg.Retry && !d.replay {
+				c.exhaust(d, newFailure(d, item))
+				continue
+			}
+			atomic.AddUint64(&c.retried, 1)
+			atomic.AddUint64(&c.byIndex(d.index).retried, 1)
+			retry = append(retry, d)
+		default:
+			if c.resolve(d, item) {
+				retry = append(retry, d)
+				continue
+			}
+			c.reject(newFailure(d, item))
+		}
+	}
+
+	return retry
+}
+
+// reviewE 整个bulk请求失败 按错误类型决定全部重发或全部丢弃
+func (c *Client) reviewE(v []*doc, err error) []*doc {
+	if classifyErr(err) != itemRetry {
+		for _, d := range v {
+			c.reject(newFailureE(d, err))
+		}
+		return nil
+	}
+
+	status := 0
+	var ee *elastic.Error
+	if errors.As(err, &ee) {
+		status = ee.Status
+	}
+
+	var retry []*doc
+	for _, d := range v {
+		d.status = status
+		if d.attempt++; d.attempt > c.cfg.Retry && !d.replay {
+			c.exhaust(d, newFailureE(d, err))
+			continue
+		}
+		atomic.AddUint64(&c.retried, 1)
+		atomic.AddUint64(&c.byIndex(d.index).retried, 1)
+		retry = append(retry, d)
+	}
+	return retry
+}
+
+// exhaust 可重试的文档超过重试次数 开启磁盘缓存时落盘等待回放
+// 回放中的文档不会走到这里 失败时保留在原分段 见deliver
+func (c *Client) exhaust(d *doc, f *failure) {
+	if c.spool == nil {
+		c.reject(f)
+		return
+	}
+	c.spill(d)
+}
+
+func (c *Client) reject(f *failure) {
+	atomic.AddUint64(&c.failed, 1)
+	atomic.AddUint64(&c.byIndex(f.doc.index).failed, 1)
+	c.bury(f)
+
+	if c.fail == nil {
+		xEnv.Errorf("%s bulk item index=%s status=%d %s: %s", c.cfg.name(), f.doc.index, f.status, f.kind, f.reason)
+		return
+	}
+
+	c.fail.Do(f, nil, func(err error) {
+		xEnv.Errorf("elastic client fail pipe call fail %v", err)
+	})
+}
+
+// Outcome 返回逐条结果计数 成功 重试 失败
+func (c *Client) Outcome() (succeed, retried, failed uint64) {
+	return atomic.LoadUint64(&c.succeed), atomic.LoadUint64(&c.retried), atomic.LoadUint64(&c.failed)
+}
+
+// split 按max_bulk_bytes拆分成多个bulk 超过上限的单个文档单独发送或直接拒绝
+func (c *Client) split(v []*doc) [][]*doc {
+	limit := c.cfg.MaxBulkBytes
+	if limit <= 0 {
+		return [][]*doc{v}
+	}
+
+	var chunks [][]*doc
+	var cur []*doc
+	size := 0
+
+	for _, d := range v {
+		n := d.size()
+		if n > limit {
+			if c.cfg.Oversize == OversizeReject {
+				c.reject(&failure{doc: d, status: http.StatusRequestEntityTooLarge, kind: "document_too_large",
+					reason: fmt.Sprintf("document %d bytes exceeds max_bulk_bytes %d", n, limit)})
+				continue
+			}
+			chunks = append(chunks, []*doc{d})
+			continue
+		}
+
+		if len(cur) > 0 && size+n > limit {
+			chunks = append(chunks, cur)
+			cur = nil
+			size = 0
+		}
+
+		cur = append(cur, d)
+		size += n
+	}
+
+	if len(cur) > 0 {
+		chunks = append(chunks, cur)
+	}
+
+	return chunks
+}
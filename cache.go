@@ -0,0 +1,82 @@
+package elastic
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lru 固定容量的缓存 ttl为0时不过期
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key    string
+	value  interface{}
+	expire time.Time
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	if size <= 0 {
+		size = 1024
+	}
+
+	return &lru{size: size, ttl: ttl, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*lruEntry)
+	if l.ttl > 0 && time.Now().After(entry.expire) {
+		l.ll.Remove(elem)
+		delete(l.items, key)
+		return nil, false
+	}
+
+	l.ll.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (l *lru) set(key string, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expire time.Time
+	if l.ttl > 0 {
+		expire = time.Now().Add(l.ttl)
+	}
+
+	if elem, ok := l.items[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expire = expire
+		l.ll.MoveToFront(elem)
+		return
+	}
+
+	l.items[key] = l.ll.PushFront(&lruEntry{key: key, value: value, expire: expire})
+	for l.ll.Len() > l.size {
+		last := l.ll.Back()
+		l.ll.Remove(last)
+		delete(l.items, last.Value.(*lruEntry).key)
+	}
+}
+
+func (l *lru) purge() {
+	l.mu.Lock()
+	l.ll.Init()
+	l.items = make(map[string]*list.Element)
+	l.mu.Unlock()
+}
@@ -10,6 +10,8 @@ import (
 	"github.com/vela-ssoc/vela-kit/pipe"
 	vswitch "github.com/vela-ssoc/vela-switch"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,18 +19,67 @@ var typeof = reflect.TypeOf((*Client)(nil)).String()
 
 type Client struct {
 	lua.SuperVelaData
-	cfg     *config
-	err     error
-	index   func(*doc) error
-	lastE   time.Time
-	denoise *denoise.Bucket
-	esapi   *elastic.Client
-	pip     *pipe.Chains
-	vsh     *vswitch.Switch
-	drop    []*cond.Cond
-	queue   chan *elastic.BulkIndexRequest
-	ctx     context.Context
-	cancel  context.CancelFunc
+	cfg        *config
+	err        error
+	index      func(*doc) error
+	id         func(*doc) error
+	digest     func(*doc) error
+	pipeline   func(*doc) error
+	routing    func(*doc) error
+	lastE      time.Time
+	denoise    *denoise.Bucket
+	esapi      *elastic.Client
+	pip        *pipe.Chains
+	vsh        *vswitch.Switch
+	drop       []*cond.Cond
+	transforms []*transform
+	groks      []*grok
+	geo        *geoip
+	enriches   []*enrich
+	lookups    []*esLookup
+	fail       *pipe.Chains
+	queue      chan *doc
+	threads    []*Thread
+	indices    sync.Map
+	indexN     int64
+	label      string
+	instance   uint32
+	conflicts  sync.Map
+	managed    []*managed
+	format     string
+	fields     []string
+	retain     *retention
+	spool      *spool
+	dead       *deadLetter
+	mu         sync.RWMutex
+	smu        sync.RWMutex
+	emu        sync.Mutex
+	once       sync.Once
+	closed     bool
+	stop       chan struct{}
+	report     *ShutdownReport
+	wg         sync.WaitGroup
+	workers    sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
+	halt       context.CancelFunc
+
+	received   uint64
+	denoised   uint64
+	dropped    uint64
+	queued     uint64
+	succeed    uint64
+	retried    uint64
+	failed     uint64
+	spooled    uint64
+	replayed   uint64
+	duplicated uint64
+
+	dropTimeout uint64
+	dropNewest  uint64
+	dropOldest  uint64
+	spilled     uint64
+	dropClosed  uint64
 }
 
 func (c *Client) Name() string {
@@ -39,58 +90,139 @@ func (c *Client) Type() string {
 	return typeof
 }
 
-func (c *Client) doBulk(v []elastic.BulkableRequest, cli *elastic.Client) error {
+func (c *Client) doBulk(v []*doc, cli *elastic.Client) ([]*doc, error) {
+	return c.send(c.ctx, v, cli)
+}
+
+func (c *Client) send(ctx context.Context, v []*doc, cli *elastic.Client) ([]*doc, error) {
 	n := len(v)
 	if n == 0 {
-		return nil
+		return nil, nil
 	}
 
-	if !c.cfg.Default {
-		bulk := cli.Bulk()
-		bulk.Add(v...)
-		_, err := bulk.Do(c.ctx)
-		return err
+	if c.cfg.Default {
+		api, err := EsApiClient()
+		if err != nil {
+			return c.reviewE(v, err), err
+		}
+		defer api.Stop()
+		cli = api
 	}
 
-	cli, err := EsApiClient()
-	if err != nil {
-		return err
+	if cli == nil {
+		return c.reviewE(v, errNoClient), errNoClient
 	}
-	defer cli.Stop()
 
+	c.DoLookup(v, cli)
+
+	var retry []*doc
+	var last error
+	for _, chunk := range c.split(v) {
+		r, err := c.bulk(ctx, chunk, cli)
+		if err != nil {
+			last = err
+		}
+		retry = append(retry, r...)
+	}
+
+	return retry, last
+}
+
+func (c *Client) bulk(ctx context.Context, v []*doc, cli *elastic.Client) ([]*doc, error) {
 	bulk := cli.Bulk()
-	bulk.Add(v...)
-	_, err = bulk.Do(c.ctx)
-	return err
+	for _, d := range v {
+		bulk.Add(d.request())
+	}
+
+	rsp, err := bulk.Do(ctx)
+	if err != nil {
+		c.setErr(err)
+		return c.reviewE(v, err), err
+	}
+
+	return c.review(v, rsp), nil
 }
 
 func (c *Client) run(n int) {
 	for i := 1; i <= n; i++ {
 		t := NewThread(c.ctx, i, c.cfg, c.doBulk)
-		go t.Accept(c.queue)
+		c.threads = append(c.threads, t)
+
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			t.Accept(c.queue)
+		}()
 	}
 }
 
 func (c *Client) Start() error {
 	c.constructor()
+	c.manage()
+	c.startRetention()
 
 	if c.cfg.Thread < 3 {
 		c.run(3)
 	} else {
 		c.run(c.cfg.Thread)
 	}
+
+	if c.spool != nil {
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.halt = cancel
+		c.wg.Add(1)
+		go c.replay(ctx)
+	}
+
+	if c.geo != nil {
+		c.watch(c.geo.interval, c.geo.reload)
+	}
+
+	for _, e := range c.enriches {
+		c.watch(e.interval, e.reload)
+	}
+
+	register(c)
 	return nil
 }
 
-func (c *Client) Close() error {
-	if c.cancel != nil {
-		c.cancel()
+// started Start之后声明的阶段需要自己启动文件检查
+func (c *Client) started() bool {
+	return c.stop != nil
+}
+
+// watch 定时检查文件是否变化 客户端关闭时退出
+func (c *Client) watch(interval time.Duration, fn func()) {
+	if interval <= 0 {
+		return
 	}
 
-	if c.queue != nil {
-		close(c.queue)
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-tk.C:
+				fn()
+			}
+		}
+	}()
+}
+
+func (c *Client) Close() error {
+	if c.stop == nil {
+		return nil
 	}
 
+	r := c.Shutdown()
+	xEnv.Infof("%s shutdown flushed=%d spooled=%d lost=%d timeout=%v elapsed=%s",
+		c.cfg.name(), r.Flushed, r.Spooled, r.Lost, r.Timeout, r.Elapsed)
 	return nil
 }
 
@@ -157,64 +289,134 @@ func (c *Client) ByDefault(d *doc) {
 }
 
 func (c *Client) Write(v []byte) (n int, err error) {
-	d, err := newDoc(v)
-	if err != nil {
-		return 0, err
+	for _, d := range c.cfg.Codec.decode(v) {
+		c.write(d)
+	}
+	return
+}
+
+func (c *Client) write(d *doc) {
+	atomic.AddUint64(&c.received, 1)
+
+	c.DoDigest(d)
+
+	c.DoGrok(d)
+
+	c.DoTransform(d)
+
+	c.DoGeoIP(d)
+
+	c.DoEnrich(d)
+
+	if c.DoTimestamp(d) {
+		atomic.AddUint64(&c.dropped, 1)
+		return
 	}
 
 	if c.denoise != nil && c.denoise.Do(d) {
-		return 0, nil
+		atomic.AddUint64(&c.denoised, 1)
+		return
 	}
 
-	err = c.index(d)
-	if err != nil {
-		return 0, err
+	//渲染失败时index为空 入队前统一走index_fallback
+	if e := c.index(d); e != nil {
+		d.index = ""
 	}
 
 	if c.DoDrop(d) {
-		return 0, nil
+		atomic.AddUint64(&c.dropped, 1)
+		return
 	}
 
+	c.DoRoute(d)
+
 	c.DoPipe(d)
 
 	c.DoSwitch(d)
 
+	c.DoID(d)
+
 	switch d.action {
 	case DROP:
-		return 0, nil
+		atomic.AddUint64(&c.dropped, 1)
+		return
 	case ACCEPT:
-		c.queue <- elastic.NewBulkIndexRequest().Index(d.index).Doc(d.data)
+		if e := c.DoFallback(d); e != nil {
+			c.reject(&failure{doc: d, kind: "invalid_index", reason: e.Error()})
+			return
+		}
+
+		if e := c.DoOp(d); e != nil {
+			c.reject(&failure{doc: d, kind: "invalid_operation", reason: e.Error()})
+			return
+		}
+		c.enqueue(d)
 		//if !c.cfg.Default {
 		//	c.queue <- elastic.NewBulkIndexRequest().Index(d.index).Doc(d.data)
-		//	return 0, nil
+		//	return
 		//}
 		////c.ByDefault(d)
 		//c.Default(elastic.NewBulkIndexRequest().Index(d.index).Doc(d.data))
 	}
-
-	return
 }
 
 func (c *Client) PrepareIndex() {
+	if c.cfg.DataStream != nil {
+		c.index = c.cfg.DataStream.apply
+		return
+	}
+
 	if c.index == nil {
-		c.index = func(d *doc) error {
-			d.index = c.cfg.Index
-			return nil
-		}
+		c.index = PrepareIndex(c.cfg.Index, nil)
+	}
+}
+
+func (c *Client) PrepareID() {
+	if c.id != nil || c.cfg.ID == "" {
+		return
+	}
+
+	fn, err := PrepareID(c.cfg.ID, c.cfg.Timestamp.Ingested)
+	if err != nil {
+		xEnv.Errorf("%s prepare id fail %v", c.cfg.name(), err)
+		return
+	}
+	c.id = fn
+
+	if method, keys, ok := hashConfig(c.cfg.ID); ok {
+		c.digest, _ = PrepareDigest(method, keys, c.cfg.Timestamp.Ingested)
 	}
 }
 
 func (c *Client) constructor() {
 	c.PrepareIndex()
+	c.PrepareID()
+	c.PrepareRoute()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	c.ctx = ctx
 	c.cancel = cancel
-	c.queue = make(chan *elastic.BulkIndexRequest, 4096)
+	c.stop = make(chan struct{})
+	c.queue = make(chan *doc, c.cfg.QueueSize)
+
+	if c.cfg.DeadLetter != nil {
+		c.dead = newDeadLetter(c.cfg.DeadLetter)
+	}
+
+	if c.cfg.Spool == "" {
+		return
+	}
+
+	sp, err := newSpool(c.cfg)
+	if err != nil {
+		xEnv.Errorf("%s spool %s open fail %v", c.cfg.name(), c.cfg.Spool, err)
+		return
+	}
+	c.spool = sp
 }
 
 func newClient(cfg *config) *Client {
-	c := &Client{cfg: cfg}
+	c := &Client{cfg: cfg, label: cfg.name(), instance: atomic.AddUint32(&instances, 1)}
 	c.V(lua.VTInit, time.Now(), typeof)
 	return c
 }
@@ -1,11 +1,13 @@
 package elastic
 
 import (
+	"bytes"
 	"github.com/olivere/elastic/v7"
 	cond "github.com/vela-ssoc/vela-cond"
 	"github.com/vela-ssoc/vela-kit/auxlib"
 	"github.com/vela-ssoc/vela-kit/denoise"
 	"github.com/vela-ssoc/vela-kit/lua"
+	"github.com/vela-ssoc/vela-kit/pipe"
 	vswitch "github.com/vela-ssoc/vela-switch"
 )
 
@@ -40,7 +42,39 @@ func (c *Client) indexL(L *lua.LState) int {
 		fields = append(fields, field)
 	}
 
+	CheckIndex(L, format, fields)
 	c.index = PrepareIndex(format, fields)
+	c.format = format
+	c.fields = fields
+	return 0
+}
+
+func (c *Client) idL(L *lua.LState) int {
+	n := L.GetTop()
+	if n == 0 {
+		L.RaiseError("set id fail got nil")
+		return 0
+	}
+
+	method := L.CheckString(1)
+	if method != HashSha1 && method != HashXXHash {
+		c.id = PrepareTemplateID(method)
+		c.digest = nil
+		return 0
+	}
+
+	var fields []string
+	for i := 2; i <= n; i++ {
+		fields = append(fields, L.CheckString(i))
+	}
+
+	fn, err := PrepareHashID(method, fields, c.cfg.Timestamp.Ingested)
+	if err != nil {
+		L.RaiseError("set id fail %v", err)
+		return 0
+	}
+	c.id = fn
+	c.digest, _ = PrepareDigest(method, fields, c.cfg.Timestamp.Ingested)
 	return 0
 }
 
@@ -61,6 +95,18 @@ func (c *Client) switchL(L *lua.LState) int {
 	return 0
 }
 
+func (c *Client) failL(L *lua.LState) int {
+	c.fail = pipe.NewByLua(L)
+	return 0
+}
+
+func (c *Client) metricsL(L *lua.LState) int {
+	var buf bytes.Buffer
+	c.samples().text(&buf)
+	L.Push(lua.S2L(buf.String()))
+	return 1
+}
+
 func (c *Client) startL(L *lua.LState) int {
 	xEnv.Start(L, c).From(L.CodeVM()).Do()
 	return 0
@@ -146,10 +192,36 @@ func (c *Client) Index(L *lua.LState, key string) lua.LValue {
 		return lua.NewFunction(c.sendL)
 	case "index":
 		return lua.NewFunction(c.indexL)
+	case "id":
+		return lua.NewFunction(c.idL)
 	case "drop":
 		return lua.NewFunction(c.dropL)
 	case "switch":
 		return lua.NewFunction(c.switchL)
+	case "fail":
+		return lua.NewFunction(c.failL)
+	case "stats":
+		return lua.NewFunction(c.statsL)
+	case "metrics":
+		return lua.NewFunction(c.metricsL)
+	case "template":
+		return lua.NewFunction(c.templateL)
+	case "component":
+		return lua.NewFunction(c.componentL)
+	case "ilm":
+		return lua.NewFunction(c.ilmL)
+	case "lookup":
+		return lua.NewFunction(c.lookupL)
+	case "enrich":
+		return lua.NewFunction(c.enrichL)
+	case "geoip":
+		return lua.NewFunction(c.geoipL)
+	case "grok":
+		return lua.NewFunction(c.grokL)
+	case "transform":
+		return lua.NewFunction(c.transformL)
+	case "retention":
+		return lua.NewFunction(c.retentionL)
 	case "denoise":
 		return c.DenoiseBucket(L)
 	}
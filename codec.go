@@ -0,0 +1,470 @@
+package elastic
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	输入解码 解析失败时按原来的方式包装成 {"@error":... , "message":...}
+	codec = "json"      默认 一次Write一个json文档
+	codec = "ndjson"    一次Write多行 每行一个json文档
+	codec = "logfmt"    key=value key2="a b"
+	codec = {type = "kv" , field_sep = "&" , value_sep = "="}
+	codec = {type = "csv" , columns = {"ip" , "user"}}  或 header = true 以第一行作为列名
+	        header = true 时列名只在客户端收到的第一行确定 之后和列名相同的行跳过 列名不同的表头按数据处理
+	codec = "syslog"    自动识别 RFC3164 RFC5424
+	codec = "raw"       整行作为message
+*/
+
+const (
+	CodecJSON   = "json"
+	CodecNDJSON = "ndjson"
+	CodecLogfmt = "logfmt"
+	CodecKV     = "kv"
+	CodecCSV    = "csv"
+	CodecSyslog = "syslog"
+	CodecRaw    = "raw"
+)
+
+type codec struct {
+	Type     string
+	FieldSep string
+	ValueSep string
+	Comma    rune
+	Header   bool
+
+	zone    *time.Location
+	mu      sync.RWMutex
+	columns []string
+}
+
+func validCodec(v string) bool {
+	switch v {
+	case CodecJSON, CodecNDJSON, CodecLogfmt, CodecKV, CodecCSV, CodecSyslog, CodecRaw:
+		return true
+	}
+	return false
+}
+
+func newCodecConfig(L *lua.LState, val lua.LValue) *codec {
+	cc := &codec{FieldSep: " ", ValueSep: "=", Comma: ','}
+
+	switch val.Type() {
+	case lua.LTString:
+		cc.Type = val.String()
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "type":
+				cc.Type = v.String()
+			case "field_sep":
+				cc.FieldSep = v.String()
+			case "value_sep":
+				cc.ValueSep = v.String()
+			case "comma":
+				if s := v.String(); len(s) > 0 {
+					cc.Comma = []rune(s)[0]
+				}
+			case "header":
+				cc.Header = lua.IsTrue(v)
+			case "columns":
+				tab, ok := v.(*lua.LTable)
+				if !ok {
+					L.RaiseError("invalid codec columns , got %s", v.Type().String())
+					return
+				}
+				cc.columns = auxlib.LTab2SS(tab)
+			}
+		})
+	default:
+		L.RaiseError("invalid codec , got %s", val.Type().String())
+		return nil
+	}
+
+	if !validCodec(cc.Type) {
+		L.RaiseError("invalid codec type , got %s", cc.Type)
+		return nil
+	}
+
+	if cc.Type == CodecCSV && len(cc.columns) == 0 && !cc.Header {
+		L.RaiseError("csv codec need columns or header = true")
+		return nil
+	}
+
+	if cc.FieldSep == "" || cc.ValueSep == "" {
+		L.RaiseError("kv codec separator can't be empty")
+		return nil
+	}
+
+	return cc
+}
+
+// envelope 无法解析的原始内容 文档异步入队 调用方会复用data 必须复制
+func envelope(data []byte, reason string) *doc {
+	return &doc{action: ACCEPT, data: map[string]interface{}{
+		"@timestamp": time.Now(),
+		"@error":     reason,
+		"message":    string(data),
+	}}
+}
+
+func fromMap(m map[string]interface{}) *doc {
+	return &doc{action: ACCEPT, data: m}
+}
+
+func (cc *codec) decode(data []byte) []*doc {
+	if cc == nil {
+		d, _ := newDoc(data)
+		return []*doc{d}
+	}
+
+	switch cc.Type {
+	case CodecNDJSON:
+		var docs []*doc
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			if line = bytes.TrimSpace(line); len(line) == 0 {
+				continue
+			}
+			d, _ := newDoc(line)
+			docs = append(docs, d)
+		}
+		return docs
+
+	case CodecLogfmt:
+		m, err := logfmt(data)
+		if err != nil {
+			return []*doc{envelope(data, err.Error())}
+		}
+		return []*doc{fromMap(m)}
+
+	case CodecKV:
+		m, err := cc.kv(data)
+		if err != nil {
+			return []*doc{envelope(data, err.Error())}
+		}
+		return []*doc{fromMap(m)}
+
+	case CodecCSV:
+		return cc.csv(data)
+
+	case CodecSyslog:
+		m, err := syslog(data, cc.zone)
+		if err != nil {
+			return []*doc{envelope(data, err.Error())}
+		}
+		return []*doc{fromMap(m)}
+
+	case CodecRaw:
+		line := strings.TrimRight(string(data), "\r\n")
+		return []*doc{fromMap(map[string]interface{}{"message": line})}
+	}
+
+	d, _ := newDoc(data)
+	return []*doc{d}
+}
+
+// logfmt key=value key="a b" 没有值的key视为true
+func logfmt(data []byte) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	s := strings.TrimSpace(string(data))
+
+	for i := 0; i < len(s); {
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i >= len(s) {
+			break
+		}
+
+		start := i
+		for i < len(s) && s[i] != '=' && s[i] != ' ' {
+			i++
+		}
+		key := s[start:i]
+		if key == "" {
+			return nil, fmt.Errorf("logfmt empty key at %d", start)
+		}
+
+		if i >= len(s) || s[i] == ' ' {
+			m[key] = true
+			continue
+		}
+		i++
+
+		if i < len(s) && s[i] == '"' {
+			end := i + 1
+			for end < len(s) && !(s[end] == '"' && s[end-1] != '\\') {
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("logfmt unterminated quote for %s", key)
+			}
+
+			v, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("logfmt invalid value for %s", key)
+			}
+			m[key] = v
+			i = end + 1
+			continue
+		}
+
+		start = i
+		for i < len(s) && s[i] != ' ' {
+			i++
+		}
+		m[key] = s[start:i]
+	}
+
+	if len(m) == 0 {
+		return nil, fmt.Errorf("logfmt no field")
+	}
+	return m, nil
+}
+
+func (cc *codec) kv(data []byte) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	s := strings.TrimSpace(string(data))
+
+	for _, pair := range strings.Split(s, cc.FieldSep) {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+
+		key, val, found := strings.Cut(pair, cc.ValueSep)
+		if !found || key == "" {
+			return nil, fmt.Errorf("kv invalid pair %s", pair)
+		}
+		m[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(val), `"'`)
+	}
+
+	if len(m) == 0 {
+		return nil, fmt.Errorf("kv no field")
+	}
+	return m, nil
+}
+
+func (cc *codec) csv(data []byte) []*doc {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = cc.Comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	var docs []*doc
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return append(docs, envelope(data, err.Error()))
+		}
+
+		cc.mu.RLock()
+		columns := cc.columns
+		cc.mu.RUnlock()
+
+		//第一行作为列名
+		if len(columns) == 0 {
+			cc.mu.Lock()
+			if len(cc.columns) == 0 {
+				cc.columns = rec
+			}
+			cc.mu.Unlock()
+			continue
+		}
+
+		//每次Write都带表头的输入 重复的表头不作为数据
+		if cc.Header && sameRow(rec, columns) {
+			continue
+		}
+
+		m := make(map[string]interface{}, len(rec))
+		for i, v := range rec {
+			key := "column_" + strconv.Itoa(i+1)
+			if i < len(columns) {
+				key = columns[i]
+			}
+			m[key] = v
+		}
+		docs = append(docs, fromMap(m))
+	}
+
+	return docs
+}
+
+func sameRow(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func syslogPri(m map[string]interface{}, pri int) {
+	m["log.syslog.priority"] = pri
+	m["log.syslog.facility.code"] = pri / 8
+	m["log.syslog.severity.code"] = pri % 8
+}
+
+func nilValue(v string) bool {
+	return v == "-" || v == ""
+}
+
+// syslog 按版本号区分 <PRI>1 为RFC5424 其余按RFC3164处理 loc为RFC3164时间的时区
+func syslog(data []byte, loc *time.Location) (map[string]interface{}, error) {
+	s := strings.TrimRight(string(data), "\r\n")
+	if len(s) < 3 || s[0] != '<' {
+		return nil, fmt.Errorf("syslog missing priority")
+	}
+
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return nil, fmt.Errorf("syslog invalid priority")
+	}
+
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return nil, fmt.Errorf("syslog invalid priority %s", s[1:end])
+	}
+
+	m := make(map[string]interface{})
+	syslogPri(m, pri)
+
+	rest := s[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		return m, rfc5424(m, rest[2:])
+	}
+	return m, rfc3164(m, rest, loc)
+}
+
+func rfc5424(m map[string]interface{}, s string) error {
+	parts := strings.SplitN(s, " ", 6)
+	if len(parts) < 5 {
+		return fmt.Errorf("rfc5424 header incomplete")
+	}
+
+	m["log.syslog.version"] = 1
+	if !nilValue(parts[0]) {
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return fmt.Errorf("rfc5424 invalid timestamp %s", parts[0])
+		}
+		m["@timestamp"] = t
+	}
+
+	if !nilValue(parts[1]) {
+		m["host.hostname"] = parts[1]
+	}
+	if !nilValue(parts[2]) {
+		m["process.name"] = parts[2]
+	}
+	if !nilValue(parts[3]) {
+		m["process.pid"] = parts[3]
+	}
+	if !nilValue(parts[4]) {
+		m["log.syslog.msgid"] = parts[4]
+	}
+
+	if len(parts) < 6 {
+		return nil
+	}
+
+	msg := parts[5]
+	switch {
+	case strings.HasPrefix(msg, "- "):
+		msg = msg[2:]
+	case msg == "-":
+		msg = ""
+	case strings.HasPrefix(msg, "["):
+		i := structuredEnd(msg)
+		if i < 0 {
+			return fmt.Errorf("rfc5424 unterminated structured data")
+		}
+		m["log.syslog.structured_data"] = msg[:i]
+		msg = strings.TrimPrefix(msg[i:], " ")
+	}
+
+	m["message"] = strings.TrimPrefix(msg, "\ufeff")
+	return nil
+}
+
+// structuredEnd 结构化数据结束的位置 引号内的]不算结束
+func structuredEnd(s string) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ']':
+			if !quoted && (i+1 >= len(s) || s[i+1] != '[') {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// rfc3164 Jan  2 15:04:05 host tag[pid]: msg 时间没有年份 按当前年份补全 没有时区 默认UTC
+func rfc3164(m map[string]interface{}, s string, loc *time.Location) error {
+	if len(s) < len(time.Stamp) {
+		m["message"] = s
+		return nil
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	now := time.Now().In(loc)
+	t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], loc)
+	if err != nil {
+		m["message"] = s
+		return nil
+	}
+
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	m["@timestamp"] = t
+
+	rest := strings.TrimPrefix(s[len(time.Stamp):], " ")
+	host, rest, found := strings.Cut(rest, " ")
+	if !found {
+		m["host.hostname"] = host
+		return nil
+	}
+	m["host.hostname"] = host
+
+	tag, msg, found := strings.Cut(rest, ": ")
+	if !found || strings.ContainsAny(tag, " ") {
+		m["message"] = rest
+		return nil
+	}
+
+	if i := strings.IndexByte(tag, '['); i > 0 && strings.HasSuffix(tag, "]") {
+		m["process.pid"] = tag[i+1 : len(tag)-1]
+		tag = tag[:i]
+	}
+	m["process.name"] = tag
+	m["message"] = msg
+	return nil
+}
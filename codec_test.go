@@ -0,0 +1,220 @@
+package elastic
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogfmt(t *testing.T) {
+	cases := []struct {
+		in   string
+		want map[string]interface{}
+		err  bool
+	}{
+		{in: `level=info msg=started`, want: map[string]interface{}{"level": "info", "msg": "started"}},
+		{in: `msg="hello world" n=1`, want: map[string]interface{}{"msg": "hello world", "n": "1"}},
+		{in: `msg="say \"hi\"" debug`, want: map[string]interface{}{"msg": `say "hi"`, "debug": true}},
+		{in: `  a=1   b=  `, want: map[string]interface{}{"a": "1", "b": ""}},
+		{in: `msg="unterminated`, err: true},
+		{in: `=1`, err: true},
+		{in: `   `, err: true},
+	}
+
+	for _, c := range cases {
+		got, err := logfmt([]byte(c.in))
+		if c.err {
+			if err == nil {
+				t.Errorf("logfmt(%q) want error , got %v", c.in, got)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("logfmt(%q) = %v , %v want %v", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestKV(t *testing.T) {
+	cases := []struct {
+		cc   *codec
+		in   string
+		want map[string]interface{}
+		err  bool
+	}{
+		{cc: &codec{FieldSep: " ", ValueSep: "="}, in: `a=1 b="x"`, want: map[string]interface{}{"a": "1", "b": "x"}},
+		{cc: &codec{FieldSep: "&", ValueSep: "="}, in: `user=root&uid=0&`, want: map[string]interface{}{"user": "root", "uid": "0"}},
+		{cc: &codec{FieldSep: ",", ValueSep: ":"}, in: `host: web , port: 80`, want: map[string]interface{}{"host": "web", "port": "80"}},
+		{cc: &codec{FieldSep: " ", ValueSep: "="}, in: `a=1 broken`, err: true},
+	}
+
+	for _, c := range cases {
+		got, err := c.cc.kv([]byte(c.in))
+		if c.err {
+			if err == nil {
+				t.Errorf("kv(%q) want error , got %v", c.in, got)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, c.want) {
+			t.Errorf("kv(%q) = %v , %v want %v", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestCSVHeader(t *testing.T) {
+	cc := &codec{Type: CodecCSV, Comma: ',', Header: true}
+
+	writes := []string{
+		"ip,user\n10.0.0.1,root\n",
+		"ip,user\n10.0.0.2,admin\n",
+		"10.0.0.3,guest,extra\n",
+	}
+
+	var got []map[string]interface{}
+	for _, w := range writes {
+		for _, d := range cc.decode([]byte(w)) {
+			got = append(got, d.data)
+		}
+	}
+
+	want := []map[string]interface{}{
+		{"ip": "10.0.0.1", "user": "root"},
+		{"ip": "10.0.0.2", "user": "admin"},
+		{"ip": "10.0.0.3", "user": "guest", "column_3": "extra"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("csv header decode = %v want %v", got, want)
+	}
+}
+
+func TestCSVColumns(t *testing.T) {
+	cc := &codec{Type: CodecCSV, Comma: ';', columns: []string{"a", "b"}}
+
+	docs := cc.decode([]byte("1;\"x;y\"\n2;z\n"))
+	if len(docs) != 2 {
+		t.Fatalf("csv columns decode %d docs want 2", len(docs))
+	}
+
+	if want := map[string]interface{}{"a": "1", "b": "x;y"}; !reflect.DeepEqual(docs[0].data, want) {
+		t.Errorf("csv columns doc = %v want %v", docs[0].data, want)
+	}
+}
+
+func TestSyslogRFC5424(t *testing.T) {
+	in := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog 1234 ID47 [exampleSDID@32473 iut="3" eventSource="App]"] An application event`
+
+	m, err := syslog([]byte(in), time.UTC)
+	if err != nil {
+		t.Fatalf("syslog rfc5424 fail %v", err)
+	}
+
+	want := map[string]interface{}{
+		"log.syslog.priority":        165,
+		"log.syslog.facility.code":   20,
+		"log.syslog.severity.code":   5,
+		"log.syslog.version":         1,
+		"@timestamp":                 time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+		"host.hostname":              "mymachine.example.com",
+		"process.name":               "evntslog",
+		"process.pid":                "1234",
+		"log.syslog.msgid":           "ID47",
+		"log.syslog.structured_data": `[exampleSDID@32473 iut="3" eventSource="App]"]`,
+		"message":                    "An application event",
+	}
+
+	for key, val := range want {
+		got := m[key]
+		if ts, ok := val.(time.Time); ok {
+			if gt, _ := got.(time.Time); !gt.Equal(ts) {
+				t.Errorf("rfc5424 %s = %v want %v", key, got, val)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(got, val) {
+			t.Errorf("rfc5424 %s = %v want %v", key, got, val)
+		}
+	}
+}
+
+func TestSyslogRFC5424Nil(t *testing.T) {
+	m, err := syslog([]byte("<14>1 - - - - - - hello\n"), time.UTC)
+	if err != nil {
+		t.Fatalf("syslog rfc5424 nil fail %v", err)
+	}
+
+	for _, key := range []string{"@timestamp", "host.hostname", "process.name", "process.pid", "log.syslog.msgid"} {
+		if _, ok := m[key]; ok {
+			t.Errorf("rfc5424 nil value %s should be absent , got %v", key, m[key])
+		}
+	}
+
+	if m["message"] != "hello" {
+		t.Errorf("rfc5424 nil message = %v want hello", m["message"])
+	}
+}
+
+func TestSyslogRFC3164(t *testing.T) {
+	m, err := syslog([]byte("<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8"), nil)
+	if err != nil {
+		t.Fatalf("syslog rfc3164 fail %v", err)
+	}
+
+	if m["host.hostname"] != "mymachine" || m["process.name"] != "su" || m["process.pid"] != "230" {
+		t.Errorf("rfc3164 header = %v %v %v", m["host.hostname"], m["process.name"], m["process.pid"])
+	}
+
+	if m["message"] != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Errorf("rfc3164 message = %v", m["message"])
+	}
+
+	ts, ok := m["@timestamp"].(time.Time)
+	if !ok || ts.Month() != time.October || ts.Day() != 11 || ts.Hour() != 22 {
+		t.Errorf("rfc3164 timestamp = %v", m["@timestamp"])
+	}
+
+	if ts.After(time.Now().Add(24 * time.Hour)) {
+		t.Errorf("rfc3164 timestamp %v in the future", ts)
+	}
+
+	if ts.Location() != time.UTC {
+		t.Errorf("rfc3164 default zone = %v want UTC", ts.Location())
+	}
+}
+
+func TestSyslogRFC3164Zone(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	cc := &codec{Type: CodecSyslog, zone: loc}
+
+	docs := cc.decode([]byte("<34>Oct 11 22:14:15 mymachine su: hello"))
+	ts, ok := docs[0].data["@timestamp"].(time.Time)
+	if !ok {
+		t.Fatalf("rfc3164 timestamp = %v", docs[0].data["@timestamp"])
+	}
+
+	if ts.Location() != loc || ts.Hour() != 22 || ts.UTC().Hour() != 14 {
+		t.Errorf("rfc3164 timestamp %v want 22:14:15 in UTC+8", ts)
+	}
+}
+
+func TestSyslogInvalid(t *testing.T) {
+	for _, in := range []string{"", "no priority", "<>x", "<999>x", "<abc>x", "<14>1 short"} {
+		if _, err := syslog([]byte(in), time.UTC); err == nil {
+			t.Errorf("syslog(%q) want error", in)
+		}
+	}
+}
+
+func TestEnvelopeCopy(t *testing.T) {
+	buf := []byte("not json")
+	d := envelope(buf, "invalid")
+
+	copy(buf, "XXXXXXXX")
+	if d.data["message"] != "not json" {
+		t.Errorf("envelope message = %v , aliases the write buffer", d.data["message"])
+	}
+}
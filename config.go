@@ -17,6 +17,14 @@ type config struct {
 	Default             bool
 	Proxy               bool
 	Index               string
+	IndexFallback       string
+	ID                  string
+	OpType              string
+	DataStream          *dataStream
+	Pipeline            string
+	Routing             string
+	Timestamp           *timestampConfig
+	IndexZone           *time.Location
 	Username            string
 	Password            string
 	TLSCA               string
@@ -39,6 +47,25 @@ type config struct {
 	Interval            int
 	Flush               int
 	PageSize            int
+	Retry               int
+	Spool               string
+	SpoolSegment        int
+	SpoolMaxSize        int
+	SpoolMaxAge         int
+	DeadLetter          *deadConfig
+	QueueSize           int
+	Overflow            string
+	OverflowTimeout     int
+	Backoff             int
+	BackoffMax          int
+	Jitter              int
+	FlushBytes          int
+	MaxBulkBytes        int
+	Oversize            string
+	Conflict            string
+	Codec               *codec
+	ShutdownTimeout     int
+	ShutdownSpool       bool
 }
 
 func (cfg *config) name() string {
@@ -79,7 +106,8 @@ func (cfg *config) Transport() (*http.Transport, error) {
 	}, nil
 }
 
-func (cfg *config) OptionsFunc() ([]elastic.ClientOptionFunc, error) {
+// OptionsFunc wrap 可以对底层的RoundTripper做一层包装
+func (cfg *config) OptionsFunc(wrap ...func(http.RoundTripper) http.RoundTripper) ([]elastic.ClientOptionFunc, error) {
 	var options []elastic.ClientOptionFunc
 
 	var tr *http.Transport
@@ -94,8 +122,13 @@ func (cfg *config) OptionsFunc() ([]elastic.ClientOptionFunc, error) {
 		return nil, err
 	}
 
+	var rt http.RoundTripper = tr
+	for _, fn := range wrap {
+		rt = fn(rt)
+	}
+
 	httpclient := &http.Client{
-		Transport: tr,
+		Transport: rt,
 		Timeout:   time.Duration(cfg.Timeout),
 	}
 
@@ -141,6 +174,32 @@ func (cfg *config) NewIndex(L *lua.LState, key string, val lua.LValue) {
 	switch key {
 	case "index":
 		cfg.Index = val.String()
+	case "id":
+		cfg.ID = val.String()
+	case "index_fallback":
+		cfg.IndexFallback = val.String()
+	case "index_timezone":
+		loc, err := time.LoadLocation(val.String())
+		if err != nil {
+			L.RaiseError("invalid index_timezone %v", err)
+			return
+		}
+		cfg.IndexZone = loc
+	case "timestamp":
+		cfg.Timestamp = checkTimestampConfig(L, val)
+	case "pipeline":
+		cfg.Pipeline = val.String()
+	case "routing":
+		cfg.Routing = val.String()
+	case "data_stream":
+		cfg.DataStream = newDataStream(L, val)
+	case "op_type":
+		op := lua.CheckString(L, val)
+		if !validOp(op) {
+			L.RaiseError("invalid op_type , got %s", op)
+			return
+		}
+		cfg.OpType = op
 	case "username":
 		cfg.Username = val.String()
 	case "password":
@@ -190,6 +249,88 @@ func (cfg *config) NewIndex(L *lua.LState, key string, val lua.LValue) {
 	case "flush":
 		cfg.Flush = lua.CheckInt(L, val)
 
+	case "flush_bytes":
+		cfg.FlushBytes = lua.CheckInt(L, val)
+
+	case "max_bulk_bytes":
+		cfg.MaxBulkBytes = lua.CheckInt(L, val)
+
+	case "oversize":
+		v := lua.CheckString(L, val)
+		if v != OversizeSingle && v != OversizeReject {
+			L.RaiseError("invalid oversize , got %s", v)
+			return
+		}
+		cfg.Oversize = v
+
+	case "codec":
+		cfg.Codec = newCodecConfig(L, val)
+
+	case "conflict":
+		v := lua.CheckString(L, val)
+		if !validConflict(v) {
+			L.RaiseError("invalid conflict , got %s", v)
+			return
+		}
+		cfg.Conflict = v
+
+	case "retry":
+		cfg.Retry = lua.CheckInt(L, val)
+
+	case "spool":
+		cfg.Spool = lua.CheckString(L, val)
+
+	case "spool_segment":
+		cfg.SpoolSegment = lua.CheckInt(L, val)
+
+	case "spool_max_size":
+		cfg.SpoolMaxSize = lua.CheckInt(L, val)
+
+	case "spool_max_age":
+		cfg.SpoolMaxAge = lua.CheckInt(L, val)
+
+	case "backoff":
+		cfg.Backoff = lua.CheckInt(L, val)
+
+	case "backoff_max":
+		cfg.BackoffMax = lua.CheckInt(L, val)
+
+	case "jitter":
+		n := lua.CheckInt(L, val)
+		if n < 0 || n > 100 {
+			L.RaiseError("invalid jitter , got %d must be 0-100", n)
+			return
+		}
+		cfg.Jitter = n
+
+	case "queue_size":
+		n := lua.CheckInt(L, val)
+		if n <= 0 {
+			L.RaiseError("invalid queue_size , got %d", n)
+			return
+		}
+		cfg.QueueSize = n
+
+	case "overflow":
+		v := lua.CheckString(L, val)
+		if !validOverflow(v) {
+			L.RaiseError("invalid overflow , got %s", v)
+			return
+		}
+		cfg.Overflow = v
+
+	case "overflow_timeout":
+		cfg.OverflowTimeout = lua.CheckInt(L, val)
+
+	case "shutdown_timeout":
+		cfg.ShutdownTimeout = lua.CheckInt(L, val)
+
+	case "shutdown_spool":
+		cfg.ShutdownSpool = lua.CheckBool(L, val)
+
+	case "dead_letter":
+		cfg.DeadLetter = newDeadConfig(L, val)
+
 	case "proxy":
 		cfg.Proxy = lua.CheckBool(L, val)
 
@@ -210,11 +351,42 @@ func newConfig(L *lua.LState) *config {
 		Interval: 1,
 		Flush:    10,
 		PageSize: 500,
+		Retry:    3,
+
+		FlushBytes:   5 << 20,
+		MaxBulkBytes: 50 << 20,
+		Oversize:     OversizeSingle,
+
+		Backoff:    200,
+		BackoffMax: 30000,
+		Jitter:     20,
+
+		QueueSize:       4096,
+		OverflowTimeout: 1000,
+
+		ShutdownTimeout: 10,
+		ShutdownSpool:   true,
+
+		Timestamp: newTimestampConfig(),
+
+		SpoolSegment: 16,
+		SpoolMaxSize: 1024,
+		SpoolMaxAge:  7 * 24 * 3600,
 	}
 
 	tab.Range(func(key string, val lua.LValue) {
 		cfg.NewIndex(L, key, val)
 	})
 
+	if cfg.Overflow == OverflowSpillToDisk && cfg.Spool == "" {
+		L.RaiseError("overflow spill_to_disk need spool")
+		return nil
+	}
+
+	//RFC3164没有时区 和timestamp.timezone保持一致
+	if cfg.Codec != nil {
+		cfg.Codec.zone = cfg.Timestamp.Zone
+	}
+
 	return cfg
 }
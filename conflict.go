@@ -0,0 +1,193 @@
+package elastic
+
+import (
+	"encoding/json"
+	"github.com/olivere/elastic/v7"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+	mapping冲突 同一字段有的agent发字符串 有的发对象
+	conflict = "stringify"  冲突字段转成json字符串
+	conflict = "namespace"  冲突字段移动到 _conflict.<field>
+	conflict = "reroute"    文档改写到 <index>-conflicts
+	处理后只重发一次 再失败按永久失败处理
+*/
+
+const (
+	ConflictStringify = "stringify"
+	ConflictNamespace = "namespace"
+	ConflictReroute   = "reroute"
+
+	conflictField = "_conflict"
+	conflictIndex = "-conflicts"
+)
+
+func validConflict(v string) bool {
+	switch v {
+	case ConflictStringify, ConflictNamespace, ConflictReroute:
+		return true
+	}
+	return false
+}
+
+var conflictTypes = map[string]bool{
+	"mapper_parsing_exception":   true,
+	"document_parsing_exception": true,
+}
+
+// illegal_argument_exception 还包括字段数上限 pipeline参数错误等 只认mapping类型冲突的原因
+var conflictIllegal = regexp.MustCompile(`mapper \[[^\]]+\] cannot be changed from type|can't merge a non object mapping \[[^\]]+\] with an object mapping`)
+
+// 从错误原因中提取字段名 按顺序匹配
+var conflictReason = []*regexp.Regexp{
+	regexp.MustCompile(`failed to parse field \[([^\]]+)\]`),
+	regexp.MustCompile(`object mapping for \[([^\]]+)\]`),
+	regexp.MustCompile(`non object mapping \[([^\]]+)\]`),
+	regexp.MustCompile(`mapper \[([^\]]+)\]`),
+	regexp.MustCompile(`field \[([^\]]+)\]`),
+}
+
+func conflictOf(item *elastic.BulkResponseItem) (string, bool) {
+	if item == nil || item.Error == nil {
+		return "", false
+	}
+
+	kind, reason := item.Error.Type, item.Error.Reason
+
+	// mapper_parsing_exception 的caused_by中通常是更具体的原因
+	if cause := item.Error.CausedBy; cause != nil {
+		if v, ok := cause["reason"].(string); ok {
+			reason = reason + " " + v
+		}
+	}
+
+	if !conflictTypes[kind] && !(kind == "illegal_argument_exception" && conflictIllegal.MatchString(reason)) {
+		return "", false
+	}
+
+	for _, re := range conflictReason {
+		if m := re.FindStringSubmatch(reason); len(m) == 2 {
+			return m[1], true
+		}
+	}
+	return "", true
+}
+
+// lookup 找到字段所在的对象 先按完整的key 再按'.'逐级查找
+func lookup(data map[string]interface{}, path string) (map[string]interface{}, string, bool) {
+	if _, ok := data[path]; ok {
+		return data, path, true
+	}
+
+	head, tail, found := strings.Cut(path, ".")
+	if !found {
+		return nil, "", false
+	}
+
+	sub, ok := data[head].(map[string]interface{})
+	if !ok {
+		return nil, "", false
+	}
+	return lookup(sub, tail)
+}
+
+// move 把字段移动到 _conflict.<field>
+func (d *doc) move(m map[string]interface{}, key, field string) {
+	ns, _ := d.data[conflictField].(map[string]interface{})
+	if ns == nil {
+		ns = make(map[string]interface{})
+		d.data[conflictField] = ns
+	}
+	ns[field] = m[key]
+	delete(m, key)
+}
+
+func (c *Client) conflictCount(field string) {
+	if field == "" {
+		field = "_unknown"
+	}
+
+	if v, ok := c.conflicts.Load(field); ok {
+		atomic.AddUint64(v.(*uint64), 1)
+		return
+	}
+
+	v, _ := c.conflicts.LoadOrStore(field, new(uint64))
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// Conflicts 按字段统计的mapping冲突次数
+func (c *Client) Conflicts() map[string]uint64 {
+	m := make(map[string]uint64)
+	c.conflicts.Range(func(key, val interface{}) bool {
+		m[key.(string)] = atomic.LoadUint64(val.(*uint64))
+		return true
+	})
+	return m
+}
+
+func (c *Client) conflictFields() []string {
+	var keys []string
+	c.conflicts.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// resolve 按配置处理冲突 返回true时文档需要重发
+func (c *Client) resolve(d *doc, item *elastic.BulkResponseItem) bool {
+	field, ok := conflictOf(item)
+	if !ok {
+		return false
+	}
+	c.conflictCount(field)
+
+	if c.cfg.Conflict == "" || d.conflict {
+		return false
+	}
+
+	switch c.cfg.Conflict {
+	case ConflictReroute:
+		if strings.HasSuffix(d.index, conflictIndex) {
+			return false
+		}
+		d.index = d.index + conflictIndex
+
+	case ConflictStringify:
+		m, key, ok := lookup(d.data, field)
+		if !ok {
+			return false
+		}
+
+		//字符串和对象冲突时 字符串无法再转换 只能移走
+		if _, isStr := m[key].(string); isStr {
+			d.move(m, key, field)
+			break
+		}
+
+		chunk, err := json.Marshal(m[key])
+		if err != nil {
+			return false
+		}
+		m[key] = string(chunk)
+
+	case ConflictNamespace:
+		m, key, ok := lookup(d.data, field)
+		if !ok {
+			return false
+		}
+
+		d.move(m, key, field)
+	}
+
+	d.conflict = true
+	d.req = nil
+	d.bytes = 0
+	return true
+}
@@ -0,0 +1,38 @@
+package elastic
+
+import (
+	"github.com/olivere/elastic/v7"
+	"testing"
+)
+
+func TestConflictOf(t *testing.T) {
+	cases := []struct {
+		kind   string
+		reason string
+		cause  string
+		field  string
+		ok     bool
+	}{
+		{kind: "mapper_parsing_exception", reason: "failed to parse field [user] of type [keyword] in document with id '1'", field: "user", ok: true},
+		{kind: "document_parsing_exception", reason: "[1:20] object mapping for [host] tried to parse field [host] as object, but found a concrete value", field: "host", ok: true},
+		{kind: "mapper_parsing_exception", reason: "failed to parse", cause: "failed to parse field [port] of type [long]", field: "port", ok: true},
+		{kind: "illegal_argument_exception", reason: "mapper [status] cannot be changed from type [long] to [text]", field: "status", ok: true},
+		{kind: "illegal_argument_exception", reason: "can't merge a non object mapping [geo] with an object mapping", field: "geo", ok: true},
+		{kind: "illegal_argument_exception", reason: "Limit of total fields [1000] has been exceeded while adding new fields [3]"},
+		{kind: "illegal_argument_exception", reason: "pipeline with id [nginx] does not exist"},
+		{kind: "strict_dynamic_mapping_exception", reason: "mapping set to strict, dynamic introduction of [extra] within [_doc] is not allowed"},
+		{kind: "version_conflict_engine_exception", reason: "[1]: version conflict, document already exists"},
+	}
+
+	for _, c := range cases {
+		item := &elastic.BulkResponseItem{Status: 400, Error: &elastic.ErrorDetails{Type: c.kind, Reason: c.reason}}
+		if c.cause != "" {
+			item.Error.CausedBy = map[string]interface{}{"reason": c.cause}
+		}
+
+		field, ok := conflictOf(item)
+		if ok != c.ok || field != c.field {
+			t.Errorf("conflictOf(%s %q) = %q , %v want %q , %v", c.kind, c.reason, field, ok, c.field, c.ok)
+		}
+	}
+}
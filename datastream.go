@@ -0,0 +1,93 @@
+package elastic
+
+import (
+	"github.com/vela-ssoc/vela-kit/lua"
+	"strings"
+	"time"
+)
+
+/*
+	data_stream = {type = "logs" , dataset = "$app" , namespace = "default"}
+	目标名称 type-dataset-namespace 使用create操作写入
+	dataset namespace 支持$field 引用文档字段
+*/
+
+type dataStream struct {
+	Type      string
+	Dataset   string
+	Namespace string
+}
+
+func newDataStream(L *lua.LState, val lua.LValue) *dataStream {
+	tab, ok := val.(*lua.LTable)
+	if !ok {
+		L.RaiseError("invalid data_stream , got %s", val.Type().String())
+		return nil
+	}
+
+	ds := &dataStream{Type: "logs", Dataset: "generic", Namespace: "default"}
+	tab.Range(func(key string, v lua.LValue) {
+		switch key {
+		case "type":
+			ds.Type = v.String()
+		case "dataset":
+			ds.Dataset = v.String()
+		case "namespace":
+			ds.Namespace = v.String()
+		}
+	})
+
+	return ds
+}
+
+// dsName 按data stream命名规则处理 小写 不能包含'-' 为空时使用默认值
+func dsName(v string, def string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	v = strings.NewReplacer("-", "_", " ", "_", "\\", "_", "/", "_", "*", "_", "?", "_",
+		"\"", "_", "<", "_", ">", "_", "|", "_", ",", "_", "#", "_").Replace(v)
+	if v == "" || v == "nil" {
+		return def
+	}
+	return v
+}
+
+func (ds *dataStream) resolve(d *doc, v string) string {
+	if len(v) > 1 && v[0] == '$' {
+		return d.Field(v[1:])
+	}
+	return v
+}
+
+func validTimestamp(v interface{}) bool {
+	switch ts := v.(type) {
+	case time.Time:
+		return !ts.IsZero()
+	case float64:
+		return ts > 0
+	case string:
+		_, err := time.Parse(time.RFC3339Nano, ts)
+		return err == nil
+	}
+	return false
+}
+
+func (ds *dataStream) apply(d *doc) error {
+	typ := dsName(ds.Type, "logs")
+	dataset := dsName(ds.resolve(d, ds.Dataset), "generic")
+	namespace := dsName(ds.resolve(d, ds.Namespace), "default")
+
+	d.index = typ + "-" + dataset + "-" + namespace
+	d.op = OpCreate
+
+	d.data["data_stream"] = map[string]interface{}{
+		"type":      typ,
+		"dataset":   dataset,
+		"namespace": namespace,
+	}
+
+	if !validTimestamp(d.data["@timestamp"]) {
+		d.data["@timestamp"] = time.Now()
+	}
+
+	return nil
+}
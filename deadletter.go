@@ -0,0 +1,188 @@
+package elastic
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+	dead_letter 永久失败的文档保存位置
+	dead_letter = "vela-dead-letter"
+	dead_letter = {index = "vela-dead-letter"}
+	dead_letter = {file = "/var/log/vela/elastic-dead.ndjson" , max_size = 100 , backups = 5}
+*/
+
+type deadConfig struct {
+	Index   string
+	File    string
+	MaxSize int
+	Backups int
+}
+
+func newDeadConfig(L *lua.LState, val lua.LValue) *deadConfig {
+	dc := &deadConfig{MaxSize: 100, Backups: 5}
+
+	switch val.Type() {
+	case lua.LTString:
+		dc.Index = val.String()
+	case lua.LTTable:
+		val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+			switch key {
+			case "index":
+				dc.Index = v.String()
+			case "file":
+				dc.File = v.String()
+			case "max_size":
+				dc.MaxSize = lua.CheckInt(L, v)
+			case "backups":
+				dc.Backups = lua.CheckInt(L, v)
+			}
+		})
+	default:
+		L.RaiseError("invalid dead_letter , got %s", val.Type().String())
+	}
+
+	return dc
+}
+
+type deadLetter struct {
+	mu   sync.Mutex
+	cfg  *deadConfig
+	fd   *os.File
+	size int64
+}
+
+func newDeadLetter(cfg *deadConfig) *deadLetter {
+	return &deadLetter{cfg: cfg}
+}
+
+func deadRecord(f *failure) map[string]interface{} {
+	chunk, _ := json.Marshal(f.doc.data)
+
+	return map[string]interface{}{
+		"@timestamp": time.Now(),
+		"index":      f.doc.index,
+		"id":         f.doc.id,
+		"op":         f.doc.op,
+		"pipeline":   f.doc.pipeline,
+		"routing":    f.doc.routing,
+		"data":       auxlib.B2S(chunk),
+		"attempt":    f.doc.attempt,
+		"error": map[string]interface{}{
+			"status": f.status,
+			"type":   f.kind,
+			"reason": f.reason,
+		},
+	}
+}
+
+func (dl *deadLetter) open() error {
+	fd, err := os.OpenFile(dl.cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	dl.fd = fd
+	dl.size = stat.Size()
+	return nil
+}
+
+// rotate file -> file.1 -> file.2 ... 超过backups的删除
+func (dl *deadLetter) rotate() error {
+	if dl.fd != nil {
+		dl.fd.Close()
+		dl.fd = nil
+	}
+
+	name := dl.cfg.File
+	if dl.cfg.Backups <= 0 {
+		os.Remove(name)
+		return dl.open()
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", name, dl.cfg.Backups))
+	for i := dl.cfg.Backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", name, i), fmt.Sprintf("%s.%d", name, i+1))
+	}
+
+	if err := os.Rename(name, name+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return dl.open()
+}
+
+func (dl *deadLetter) write(rec map[string]interface{}) error {
+	chunk, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.fd == nil {
+		if err = dl.open(); err != nil {
+			return err
+		}
+	}
+
+	if limit := int64(dl.cfg.MaxSize) << 20; limit > 0 && dl.size >= limit {
+		if err = dl.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := dl.fd.Write(append(chunk, '\n'))
+	dl.size += int64(n)
+	return err
+}
+
+func (dl *deadLetter) close() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	if dl.fd == nil {
+		return nil
+	}
+
+	err := dl.fd.Close()
+	dl.fd = nil
+	return err
+}
+
+// bury 写入死信 优先写备用索引 队列已满或未配置索引时写本地文件
+func (c *Client) bury(f *failure) {
+	if c.dead == nil || f.doc.dead {
+		return
+	}
+
+	rec := deadRecord(f)
+
+	if c.dead.cfg.Index != "" {
+		d := &doc{action: ACCEPT, dead: true, index: c.dead.cfg.Index, data: rec}
+		if c.offer(d) {
+			return
+		}
+	}
+
+	if c.dead.cfg.File == "" {
+		xEnv.Errorf("%s dead letter queue full drop doc index=%s", c.cfg.name(), f.doc.index)
+		return
+	}
+
+	if err := c.dead.write(rec); err != nil {
+		xEnv.Errorf("%s dead letter write %s fail %v", c.cfg.name(), c.dead.cfg.File, err)
+	}
+}
@@ -2,11 +2,14 @@ package elastic
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic/v7"
 	cond "github.com/vela-ssoc/vela-cond"
 	"github.com/vela-ssoc/vela-kit/auxlib"
 	"github.com/vela-ssoc/vela-kit/kind"
 	"github.com/vela-ssoc/vela-kit/strutil"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,9 +19,53 @@ const (
 )
 
 type doc struct {
-	action uint8
-	index  string
-	data   map[string]interface{}
+	action   uint8
+	attempt  int
+	status   int
+	bytes    int
+	dead     bool
+	conflict bool
+	looked   bool
+	replay   bool
+	id       string
+	digest   string
+	op       string
+	script   string
+	params   map[string]interface{}
+	index    string
+	pipeline string
+	routing  string
+	ts       time.Time
+	loc      *time.Location
+	data     map[string]interface{}
+	req      elastic.BulkableRequest
+}
+
+// request 缓存生成的bulk请求 计算大小和发送时共用一次编码
+func (d *doc) request() elastic.BulkableRequest {
+	if d.req == nil {
+		d.req = d.build()
+	}
+	return d.req
+}
+
+// size 编码后的bulk请求字节数 包含换行
+func (d *doc) size() int {
+	if d.bytes > 0 {
+		return d.bytes
+	}
+
+	lines, err := d.request().Source()
+	if err != nil {
+		return 0
+	}
+
+	n := 0
+	for _, line := range lines {
+		n += len(line) + 1
+	}
+	d.bytes = n
+	return n
 }
 
 func (d *doc) bulk() []byte {
@@ -28,11 +75,18 @@ func (d *doc) bulk() []byte {
 		return nil
 	}
 
+	action := OpIndex
+	if d.op == OpCreate {
+		action = OpCreate
+	}
+
 	enc := kind.NewJsonEncoder()
 	enc.WriteByte('{')
-	enc.Tab("index")
+	enc.Tab(action)
 	enc.KV("_index", d.index)
-	enc.KV("_type", "_doc")
+	if d.id != "" {
+		enc.KV("_id", d.id)
+	}
 	enc.End("}}")
 	enc.Char('\n')
 	enc.Copy(chunk)
@@ -41,16 +95,42 @@ func (d *doc) bulk() []byte {
 
 }
 
+// time 索引日期变量使用的时间 优先事件时间 默认UTC
+func (d *doc) time() time.Time {
+	t := d.ts
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	if d.loc == nil {
+		return t.UTC()
+	}
+	return t.In(d.loc)
+}
+
 func (d *doc) v(key string) interface{} {
 	switch key {
 	case "day":
-		return time.Now().Format("2006-01-02")
+		return d.time().Format("2006-01-02")
 	case "today":
-		return strconv.Itoa(time.Now().Day())
+		return strconv.Itoa(d.time().Day())
+	case "hour":
+		return d.time().Format("2006-01-02-15")
+	case "week":
+		year, week := d.time().ISOWeek()
+		return fmt.Sprintf("%d-w%02d", year, week)
 	case "month":
-		return time.Now().Format("2006-01")
+		return d.time().Format("2006-01")
+	case "quarter":
+		t := d.time()
+		return fmt.Sprintf("%d-q%d", t.Year(), (int(t.Month())-1)/3+1)
 	case "year":
-		return time.Now().Format("2006")
+		return d.time().Format("2006")
+	}
+
+	// $time{2006.01.02} 自定义格式
+	if strings.HasPrefix(key, "time{") && strings.HasSuffix(key, "}") {
+		return d.time().Format(key[5 : len(key)-1])
 	}
 
 	return d.data[key]
@@ -76,15 +156,13 @@ func (d *doc) Compare(key, val string, method cond.Method) bool {
 func newDoc(data []byte) (*doc, error) {
 	d := doc{action: ACCEPT}
 	err := json.Unmarshal(data, &d.data)
-	now := time.Now()
-	if err != nil {
-		d.data = map[string]interface{}{
-			"@timestamp": now,
-			"@error":     err.Error(),
-			"message":    auxlib.B2S(data),
+	if err != nil || d.data == nil {
+		reason := "null document"
+		if err != nil {
+			reason = err.Error()
 		}
-	} else {
-		d.data["@timestamp"] = now
+
+		return envelope(data, reason), nil
 	}
 
 	return &d, nil
@@ -0,0 +1,252 @@
+package elastic
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	文档ID 重试 kafka重复投递 spool回放时覆盖而不是重复写入
+	cli.id("$host-$pid-$ts")              字段模板
+	cli.id("sha1" , "host" , "pid" , "ts") 指定字段的内容hash
+	cli.id("xxhash")                      整个文档的内容hash
+	整个文档hash在grok 字段转换 geoip 补充字段之前按解码后的文档计算 不含op_type和入库时间
+	查找表或mmdb重新加载后同一事件的id不变
+
+	配置: id = "$host-$pid-$ts" 或 id = "sha1:host,pid,ts"
+*/
+
+const (
+	HashSha1   = "sha1"
+	HashXXHash = "xxhash"
+)
+
+type idPart struct {
+	field bool
+	text  string
+}
+
+// parseTemplate 把 "$host-$pid" 拆成字面量和字段 字段名由字母数字 _ . @ 组成
+func parseTemplate(tpl string) []idPart {
+	var parts []idPart
+	var lit strings.Builder
+
+	flush := func() {
+		if lit.Len() > 0 {
+			parts = append(parts, idPart{text: lit.String()})
+			lit.Reset()
+		}
+	}
+
+	for i := 0; i < len(tpl); i++ {
+		ch := tpl[i]
+		if ch != '$' {
+			lit.WriteByte(ch)
+			continue
+		}
+
+		j := i + 1
+		for j < len(tpl) && isFieldChar(tpl[j]) {
+			j++
+		}
+
+		// $time{2006.01.02}
+		if tpl[i+1:j] == "time" && j < len(tpl) && tpl[j] == '{' {
+			if end := strings.IndexByte(tpl[j:], '}'); end > 0 {
+				j = j + end + 1
+			}
+		}
+
+		if j == i+1 {
+			lit.WriteByte(ch)
+			continue
+		}
+
+		flush()
+		parts = append(parts, idPart{field: true, text: tpl[i+1 : j]})
+		i = j - 1
+	}
+	flush()
+
+	return parts
+}
+
+func isFieldChar(ch byte) bool {
+	return ch == '_' || ch == '.' || ch == '@' ||
+		(ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (ch >= '0' && ch <= '9')
+}
+
+// fieldTemplate 渲染字段模板 字段不存在时返回错误
+func fieldTemplate(tpl string) func(*doc) (string, error) {
+	parts := parseTemplate(tpl)
+
+	return func(d *doc) (string, error) {
+		var buf strings.Builder
+		for _, p := range parts {
+			if !p.field {
+				buf.WriteString(p.text)
+				continue
+			}
+
+			if d.v(p.text) == nil {
+				return "", fmt.Errorf("template field %s not found", p.text)
+			}
+			buf.WriteString(d.Field(p.text))
+		}
+		return buf.String(), nil
+	}
+}
+
+func PrepareTemplateID(tpl string) func(*doc) error {
+	render := fieldTemplate(tpl)
+
+	return func(d *doc) error {
+		id, err := render(d)
+		if err != nil {
+			return err
+		}
+		d.id = id
+		return nil
+	}
+}
+
+func newHash(method string) (func() hash.Hash, error) {
+	switch method {
+	case HashSha1:
+		return sha1.New, nil
+	case HashXXHash:
+		return func() hash.Hash { return xxhash.New() }, nil
+	}
+	return nil, fmt.Errorf("invalid id hash %s", method)
+}
+
+// PrepareHashID exclude 整个文档hash时跳过的字段 每次投递都会变化的入库时间不能参与计算
+func PrepareHashID(method string, fields []string, exclude ...string) (func(*doc) error, error) {
+	newH, err := newHash(method)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) == 0 {
+		digest, _ := PrepareDigest(method, nil, exclude...)
+		return func(d *doc) error {
+			if d.digest == "" {
+				if err := digest(d); err != nil {
+					return err
+				}
+			}
+			d.id = d.digest
+			return nil
+		}, nil
+	}
+
+	return func(d *doc) error {
+		h := newH()
+		for _, key := range fields {
+			h.Write([]byte(key))
+			h.Write([]byte{'='})
+			h.Write([]byte(d.Field(key)))
+			h.Write([]byte{0})
+		}
+		d.id = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}, nil
+}
+
+// PrepareDigest 整个文档的内容hash 写入d.digest 指定了字段时返回nil
+func PrepareDigest(method string, fields []string, exclude ...string) (func(*doc) error, error) {
+	newH, err := newHash(method)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) > 0 {
+		return nil, nil
+	}
+
+	skip := map[string]bool{opTypeField: true}
+	for _, key := range exclude {
+		if key != "" {
+			skip[key] = true
+		}
+	}
+
+	return func(d *doc) error {
+		keys := make([]string, 0, len(d.data))
+		for key := range d.data {
+			if skip[key] {
+				continue
+			}
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		h := newH()
+		for _, key := range keys {
+			chunk, err := json.Marshal(d.data[key])
+			if err != nil {
+				return err
+			}
+			h.Write([]byte(strconv.Quote(key)))
+			h.Write([]byte{'='})
+			h.Write(chunk)
+			h.Write([]byte{0})
+		}
+		d.digest = hex.EncodeToString(h.Sum(nil))
+		return nil
+	}, nil
+}
+
+// hashConfig 解析 "sha1:host,pid" 不是hash方式时返回false
+func hashConfig(v string) (string, []string, bool) {
+	method, fields, _ := strings.Cut(v, ":")
+	if method != HashSha1 && method != HashXXHash {
+		return "", nil, false
+	}
+
+	var keys []string
+	for _, key := range strings.Split(fields, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return method, keys, true
+}
+
+// PrepareID 解析配置中的id 例如 "$host-$pid" 或 "sha1:host,pid"
+func PrepareID(v string, exclude ...string) (func(*doc) error, error) {
+	if method, keys, ok := hashConfig(v); ok {
+		return PrepareHashID(method, keys, exclude...)
+	}
+
+	return PrepareTemplateID(v), nil
+}
+
+// DoDigest 整个文档hash时在解码后立即计算
+func (c *Client) DoDigest(d *doc) {
+	if c.digest == nil {
+		return
+	}
+
+	if err := c.digest(d); err != nil {
+		xEnv.Errorf("%s doc digest fail %v", c.cfg.name(), err)
+	}
+}
+
+// DoID switch或pipe中的 upsert/delete/script 已经指定id时不覆盖
+func (c *Client) DoID(d *doc) {
+	if c.id == nil || d.id != "" {
+		return
+	}
+
+	if err := c.id(d); err != nil {
+		xEnv.Errorf("%s doc id fail %v", c.cfg.name(), err)
+	}
+}
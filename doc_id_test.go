@@ -0,0 +1,54 @@
+package elastic
+
+import "testing"
+
+func TestDigestBeforeEnrich(t *testing.T) {
+	c := &Client{cfg: &config{ID: HashXXHash, Timestamp: newTimestampConfig()}}
+	c.PrepareID()
+
+	newEvent := func(extra map[string]interface{}) *doc {
+		d := &doc{data: map[string]interface{}{"host": "web01", "pid": 42, "@timestamp": "2024-01-02T03:04:05Z"}}
+		c.DoDigest(d)
+		for k, v := range extra {
+			d.data[k] = v
+		}
+		c.DoID(d)
+		return d
+	}
+
+	a := newEvent(map[string]interface{}{"asset.owner": "ops", "event.ingested": "now"})
+	b := newEvent(map[string]interface{}{"asset.owner": "sec", "geo.city_name": "London"})
+	if a.id == "" || a.id != b.id {
+		t.Errorf("id changed with enrichment %q != %q", a.id, b.id)
+	}
+
+	d := &doc{data: map[string]interface{}{"host": "web01", "pid": 42, "@timestamp": "2024-01-02T03:04:05Z", opTypeField: OpCreate}}
+	c.DoDigest(d)
+	c.DoID(d)
+	if d.id != a.id {
+		t.Errorf("op_type changed the id %q != %q", d.id, a.id)
+	}
+
+	d = &doc{data: map[string]interface{}{"host": "web01", "pid": 42, "@timestamp": "2024-01-02T03:04:06Z"}}
+	c.DoDigest(d)
+	c.DoID(d)
+	if d.id == a.id {
+		t.Errorf("different @timestamp produced the same id")
+	}
+}
+
+func TestHashFieldsNoDigest(t *testing.T) {
+	c := &Client{cfg: &config{ID: "sha1:host,pid", Timestamp: newTimestampConfig()}}
+	c.PrepareID()
+	if c.digest != nil {
+		t.Fatalf("field hash should not precompute a digest")
+	}
+
+	d := &doc{data: map[string]interface{}{"host": "web01", "pid": 42}}
+	c.DoID(d)
+	d2 := &doc{data: map[string]interface{}{"host": "web01", "pid": 42, "extra": 1}}
+	c.DoID(d2)
+	if d.id == "" || d.id != d2.id {
+		t.Errorf("field hash %q != %q", d.id, d2.id)
+	}
+}
@@ -3,9 +3,21 @@ package elastic
 import (
 	"fmt"
 	"github.com/vela-ssoc/vela-kit/lua"
+	"strings"
 )
 
 func PrepareIndex(format string, fields []string) func(*doc) error { // evt-log-%s
+	if len(fields) == 0 && strings.Contains(format, "${") {
+		fn, err := PrepareIndexTemplate(format)
+		if err != nil {
+			return func(d *doc) error {
+				d.index = ""
+				return err
+			}
+		}
+		return fn
+	}
+
 	if len(fields) == 0 {
 		return func(d *doc) error {
 			d.index = format
@@ -23,10 +35,10 @@ func PrepareIndex(format string, fields []string) func(*doc) error { // evt-log-
 
 			val := d.v(key[1:])
 			if val == nil {
-				vals = append(vals, "nil")
-			} else {
-				vals = append(vals, val)
+				d.index = ""
+				return fmt.Errorf("index field %s not found", key)
 			}
+			vals = append(vals, val)
 		}
 
 		d.index = fmt.Sprintf(format, vals...)
@@ -48,3 +60,14 @@ func PrepareIndexL(format string, fields []string) lua.GoFuncErr {
 
 	return goFunc
 }
+
+// CheckIndex 新模板语法在加载时检查 避免运行时才发现错误
+func CheckIndex(L *lua.LState, format string, fields []string) {
+	if len(fields) > 0 || !strings.Contains(format, "${") {
+		return
+	}
+
+	if _, err := parseIndexTemplate(format); err != nil {
+		L.RaiseError("%v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package elastic
+
+import (
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"github.com/vela-ssoc/vela-kit/lua"
+)
+
+/*
+	bulk 操作类型
+	index  默认 覆盖写入
+	create 只创建 已存在时返回409 data stream 必须使用
+	update 局部更新 文档必须存在
+	upsert 局部更新 不存在时按文档创建
+	script 脚本更新 不存在时按文档创建
+	delete 删除
+*/
+
+const (
+	OpIndex  = "index"
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpUpsert = "upsert"
+	OpScript = "script"
+	OpDelete = "delete"
+)
+
+func validOp(op string) bool {
+	switch op {
+	case OpIndex, OpCreate, OpUpdate, OpUpsert, OpScript, OpDelete:
+		return true
+	}
+	return false
+}
+
+// needID update delete 等操作必须指定_id
+func needID(op string) bool {
+	switch op {
+	case OpUpdate, OpUpsert, OpScript, OpDelete:
+		return true
+	}
+	return false
+}
+
+func (d *doc) build() elastic.BulkableRequest {
+	switch d.op {
+	case OpUpdate, OpUpsert:
+		r := elastic.NewBulkUpdateRequest().Index(d.index).Id(d.id).Doc(d.data).RetryOnConflict(3)
+		if d.op == OpUpsert {
+			r.DocAsUpsert(true)
+		}
+
+		if d.routing != "" {
+			r.Routing(d.routing)
+		}
+		return r
+
+	case OpScript:
+		script := elastic.NewScript(d.script)
+		if len(d.params) > 0 {
+			script.Params(d.params)
+		}
+		r := elastic.NewBulkUpdateRequest().Index(d.index).Id(d.id).Script(script).Upsert(d.data).RetryOnConflict(3)
+		if d.routing != "" {
+			r.Routing(d.routing)
+		}
+		return r
+
+	case OpDelete:
+		r := elastic.NewBulkDeleteRequest().Index(d.index).Id(d.id)
+		if d.routing != "" {
+			r.Routing(d.routing)
+		}
+		return r
+
+	default:
+		r := elastic.NewBulkIndexRequest().Index(d.index).Doc(d.data)
+		if d.id != "" {
+			r.Id(d.id)
+		}
+
+		if d.op == OpCreate {
+			r.OpType(OpCreate)
+		}
+
+		if d.pipeline != "" {
+			r.Pipeline(d.pipeline)
+		}
+
+		if d.routing != "" {
+			r.Routing(d.routing)
+		}
+		return r
+	}
+}
+
+// opTypeField 文档中指定操作类型的字段 发送前删除
+const opTypeField = "op_type"
+
+// DoOp 确定文档的操作类型 优先级: lua动作 > 文档中的op_type字段 > 配置
+func (c *Client) DoOp(d *doc) error {
+	if v, ok := d.data[opTypeField]; ok {
+		delete(d.data, opTypeField)
+		if op, _ := v.(string); d.op == "" && validOp(op) {
+			d.op = op
+		}
+	}
+
+	if d.op == "" {
+		d.op = c.cfg.OpType
+	}
+
+	if needID(d.op) && d.id == "" {
+		return fmt.Errorf("%s operation need doc id", d.op)
+	}
+	return nil
+}
+
+func newLuaOp(L *lua.LState, op string) lua.GoFuncErr {
+	var id func(*doc) error
+	if L.GetTop() > 0 {
+		id = PrepareTemplateID(L.CheckString(1))
+	}
+
+	return func(v ...interface{}) error {
+		d, ok := v[0].(*doc)
+		if !ok {
+			return fmt.Errorf("invalid message")
+		}
+
+		d.op = op
+		if id != nil {
+			return id(d)
+		}
+		return nil
+	}
+}
+
+func newLuaCreateL(L *lua.LState) int {
+	L.Push(newLuaOp(L, OpCreate))
+	return 1
+}
+
+func newLuaUpdateL(L *lua.LState) int {
+	L.Push(newLuaOp(L, OpUpdate))
+	return 1
+}
+
+func newLuaUpsertL(L *lua.LState) int {
+	L.Push(newLuaOp(L, OpUpsert))
+	return 1
+}
+
+func newLuaDeleteL(L *lua.LState) int {
+	L.Push(newLuaOp(L, OpDelete))
+	return 1
+}
+
+/*
+	vela.elastic.script("ctx._source.count += params.n" , {n = 1} , "$host")
+*/
+
+func newLuaScriptL(L *lua.LState) int {
+	source := L.CheckString(1)
+
+	var params map[string]interface{}
+	if tab, ok := L.Get(2).(*lua.LTable); ok {
+		params = make(map[string]interface{})
+		tab.Range(func(key string, val lua.LValue) {
+			if val.Type() == lua.LTBool {
+				params[key] = lua.IsTrue(val)
+				return
+			}
+
+			if f, ok := val.AssertFloat64(); ok {
+				params[key] = f
+				return
+			}
+			params[key] = val.String()
+		})
+	}
+
+	var id func(*doc) error
+	if L.GetTop() >= 3 {
+		id = PrepareTemplateID(L.CheckString(3))
+	}
+
+	L.Push(lua.GoFuncErr(func(v ...interface{}) error {
+		d, ok := v[0].(*doc)
+		if !ok {
+			return fmt.Errorf("invalid message")
+		}
+
+		d.op = OpScript
+		d.script = source
+		d.params = params
+		if id != nil {
+			return id(d)
+		}
+		return nil
+	}))
+	return 1
+}
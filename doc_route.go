@@ -0,0 +1,84 @@
+package elastic
+
+import (
+	"fmt"
+	"github.com/vela-ssoc/vela-kit/lua"
+)
+
+/*
+	pipeline routing 支持固定值和$field模板
+	local cli = vela.elastic.cli{pipeline = "geoip" , routing = "$host"}
+
+	switch 中按文档覆盖
+	vsh.case("app = nginx").pipe(vela.elastic.pipeline("nginx-access"))
+	vsh.case("app = nginx").pipe(vela.elastic.routing("$client_ip"))
+*/
+
+func PreparePipeline(tpl string) func(*doc) error {
+	render := fieldTemplate(tpl)
+	return func(d *doc) error {
+		v, err := render(d)
+		if err != nil {
+			return err
+		}
+		d.pipeline = v
+		return nil
+	}
+}
+
+func PrepareRouting(tpl string) func(*doc) error {
+	render := fieldTemplate(tpl)
+	return func(d *doc) error {
+		v, err := render(d)
+		if err != nil {
+			return err
+		}
+		d.routing = v
+		return nil
+	}
+}
+
+func (c *Client) PrepareRoute() {
+	if c.pipeline == nil && c.cfg.Pipeline != "" {
+		c.pipeline = PreparePipeline(c.cfg.Pipeline)
+	}
+
+	if c.routing == nil && c.cfg.Routing != "" {
+		c.routing = PrepareRouting(c.cfg.Routing)
+	}
+}
+
+func (c *Client) DoRoute(d *doc) {
+	if c.pipeline != nil {
+		if err := c.pipeline(d); err != nil {
+			xEnv.Errorf("%s doc pipeline fail %v", c.cfg.name(), err)
+		}
+	}
+
+	if c.routing != nil {
+		if err := c.routing(d); err != nil {
+			xEnv.Errorf("%s doc routing fail %v", c.cfg.name(), err)
+		}
+	}
+}
+
+func newLuaRouteL(L *lua.LState, prepare func(string) func(*doc) error) int {
+	fn := prepare(L.CheckString(1))
+
+	L.Push(lua.GoFuncErr(func(v ...interface{}) error {
+		d, ok := v[0].(*doc)
+		if !ok {
+			return fmt.Errorf("invalid message")
+		}
+		return fn(d)
+	}))
+	return 1
+}
+
+func newLuaPipelineL(L *lua.LState) int {
+	return newLuaRouteL(L, PreparePipeline)
+}
+
+func newLuaRoutingL(L *lua.LState) int {
+	return newLuaRouteL(L, PrepareRouting)
+}
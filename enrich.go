@@ -0,0 +1,383 @@
+package elastic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"github.com/vela-ssoc/vela-kit/strutil"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	本地查找表 按文档字段匹配一行 把指定列合并到文档
+	key 支持精确值和CIDR(如 10.0.0.0/8) CIDR按最长前缀匹配
+	声明时加载 文件变化后整表重新加载 加载失败时继续使用旧表
+
+	cli.enrich{
+		file        = "share/assets.csv",   --csv第一行为列名 json为对象数组或 {key = {...}}
+		key         = "ip",
+		match_field = "source.ip",
+		fields      = {"owner" , "hostname"},  --默认除key以外的全部列
+		target      = "asset",                 --写入 asset.owner 默认写到顶层
+		interval    = 30,
+	}
+*/
+
+type lookupRow map[string]interface{}
+
+type lookupCIDR struct {
+	net *net.IPNet
+	row lookupRow
+}
+
+type lookupTable struct {
+	exact map[string]lookupRow
+	cidrs []lookupCIDR
+	mtime time.Time
+	size  int64
+}
+
+func (t *lookupTable) rows() int {
+	return len(t.exact) + len(t.cidrs)
+}
+
+func (t *lookupTable) add(key string, row lookupRow) {
+	key = strings.TrimSpace(key)
+	if strings.Contains(key, "/") {
+		if _, ipNet, err := net.ParseCIDR(key); err == nil {
+			t.cidrs = append(t.cidrs, lookupCIDR{net: ipNet, row: row})
+			return
+		}
+	}
+	t.exact[key] = row
+}
+
+func (t *lookupTable) find(v string) (lookupRow, bool) {
+	if row, ok := t.exact[v]; ok {
+		return row, true
+	}
+
+	if len(t.cidrs) == 0 {
+		return nil, false
+	}
+
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, false
+	}
+
+	for _, item := range t.cidrs {
+		if item.net.Contains(ip) {
+			return item.row, true
+		}
+	}
+	return nil, false
+}
+
+type enrich struct {
+	file     string
+	format   string
+	key      string
+	match    string
+	fields   []string
+	target   string
+	interval time.Duration
+	table    atomic.Value
+
+	hit  uint64
+	miss uint64
+}
+
+func (e *enrich) load() (*lookupTable, error) {
+	st, err := os.Stat(e.file)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Open(e.file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	t := &lookupTable{exact: make(map[string]lookupRow), mtime: st.ModTime(), size: st.Size()}
+	if e.format == "json" {
+		err = e.loadJSON(fd, t)
+	} else {
+		err = e.loadCSV(fd, t)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// 最长前缀优先
+	sort.SliceStable(t.cidrs, func(i, j int) bool {
+		a, _ := t.cidrs[i].net.Mask.Size()
+		b, _ := t.cidrs[j].net.Mask.Size()
+		return a > b
+	})
+	return t, nil
+}
+
+func (e *enrich) loadCSV(r io.Reader, t *lookupTable) error {
+	rd := csv.NewReader(r)
+	rd.FieldsPerRecord = -1
+
+	header, err := rd.Read()
+	if err != nil {
+		return fmt.Errorf("enrich %s read header fail %v", e.file, err)
+	}
+
+	idx := -1
+	for i, col := range header {
+		header[i] = strings.TrimSpace(col)
+		if header[i] == e.key {
+			idx = i
+		}
+	}
+
+	if idx < 0 {
+		return fmt.Errorf("enrich %s key column %s not found", e.file, e.key)
+	}
+
+	for {
+		rec, err := rd.Read()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("enrich %s read fail %v", e.file, err)
+		}
+
+		if idx >= len(rec) {
+			continue
+		}
+
+		row := make(lookupRow, len(rec))
+		for i, v := range rec {
+			if i < len(header) && i != idx {
+				row[header[i]] = v
+			}
+		}
+		t.add(rec[idx], row)
+	}
+}
+
+func (e *enrich) loadJSON(r io.Reader, t *lookupTable) error {
+	var v interface{}
+	if err := json.NewDecoder(r).Decode(&v); err != nil {
+		return fmt.Errorf("enrich %s decode fail %v", e.file, err)
+	}
+
+	switch items := v.(type) {
+	case []interface{}:
+		for _, item := range items {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			key, ok := m[e.key]
+			if !ok {
+				continue
+			}
+
+			row := make(lookupRow, len(m))
+			for k, val := range m {
+				if k != e.key {
+					row[k] = val
+				}
+			}
+			t.add(strutil.String(key), row)
+		}
+
+	case map[string]interface{}:
+		for key, item := range items {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			t.add(key, m)
+		}
+
+	default:
+		return fmt.Errorf("enrich %s need array or object", e.file)
+	}
+
+	return nil
+}
+
+// reload 文件变化后重新加载 成功后整表替换
+func (e *enrich) reload() {
+	st, err := os.Stat(e.file)
+	if err != nil {
+		return
+	}
+
+	old := e.current()
+	if old != nil && st.ModTime().Equal(old.mtime) && st.Size() == old.size {
+		return
+	}
+
+	t, err := e.load()
+	if err != nil {
+		xEnv.Errorf("enrich reload %s fail %v", e.file, err)
+		return
+	}
+
+	e.table.Store(t)
+	xEnv.Infof("enrich reload %s rows=%d", e.file, t.rows())
+}
+
+func (e *enrich) current() *lookupTable {
+	t, _ := e.table.Load().(*lookupTable)
+	return t
+}
+
+func (e *enrich) do(d *doc) {
+	t := e.current()
+	if t == nil {
+		return
+	}
+
+	v, ok := d.get(e.match)
+	if !ok || v == nil {
+		return
+	}
+
+	row, ok := t.find(strutil.String(v))
+	if !ok {
+		atomic.AddUint64(&e.miss, 1)
+		return
+	}
+	atomic.AddUint64(&e.hit, 1)
+
+	put := func(key string, val interface{}) {
+		if e.target != "" {
+			key = e.target + "." + key
+		}
+		d.set(key, val)
+	}
+
+	if len(e.fields) == 0 {
+		for key, val := range row {
+			put(key, val)
+		}
+		return
+	}
+
+	for _, key := range e.fields {
+		if val, ok := row[key]; ok {
+			put(key, val)
+		}
+	}
+}
+
+type EnrichStats struct {
+	File string
+	Rows int
+	Hit  uint64
+	Miss uint64
+}
+
+func (e *enrich) Stats() EnrichStats {
+	s := EnrichStats{File: e.file, Hit: atomic.LoadUint64(&e.hit), Miss: atomic.LoadUint64(&e.miss)}
+	if t := e.current(); t != nil {
+		s.Rows = t.rows()
+	}
+	return s
+}
+
+func (es EnrichStats) table(L *lua.LState) *lua.LTable {
+	tab := L.NewTable()
+	tab.RawSetString("file", lua.S2L(es.File))
+	tab.RawSetString("rows", lua.LInt(es.Rows))
+	tab.RawSetString("hit", lua.LNumber(es.Hit))
+	tab.RawSetString("miss", lua.LNumber(es.Miss))
+	return tab
+}
+
+// enrichStages 启动后声明的enrich会在写入时追加
+func (c *Client) enrichStages() []*enrich {
+	c.smu.RLock()
+	defer c.smu.RUnlock()
+	return c.enriches
+}
+
+func (c *Client) DoEnrich(d *doc) {
+	for _, e := range c.enrichStages() {
+		e.do(d)
+	}
+}
+
+func (c *Client) enrichL(L *lua.LState) int {
+	tab := L.CheckTable(1)
+	e := &enrich{interval: 30 * time.Second}
+
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "file":
+			e.file = val.String()
+		case "format":
+			e.format = val.String()
+		case "key":
+			e.key = val.String()
+		case "match_field":
+			e.match = val.String()
+		case "fields":
+			if t, ok := val.(*lua.LTable); ok {
+				e.fields = auxlib.LTab2SS(t)
+			} else {
+				e.fields = []string{val.String()}
+			}
+		case "target":
+			e.target = val.String()
+		case "interval":
+			e.interval = time.Duration(lua.CheckInt(L, val)) * time.Second
+		}
+	})
+
+	if e.file == "" || e.key == "" || e.match == "" {
+		L.RaiseError("enrich need file key match_field")
+		return 0
+	}
+
+	if e.format == "" {
+		e.format = "csv"
+		if strings.EqualFold(filepath.Ext(e.file), ".json") {
+			e.format = "json"
+		}
+	}
+
+	if e.format != "csv" && e.format != "json" {
+		L.RaiseError("invalid enrich format , got %s", e.format)
+		return 0
+	}
+
+	t, err := e.load()
+	if err != nil {
+		L.RaiseError("%s enrich load %s fail %v", c.cfg.name(), e.file, err)
+		return 0
+	}
+	e.table.Store(t)
+
+	c.smu.Lock()
+	c.enriches = append(c.enriches[:len(c.enriches):len(c.enriches)], e)
+	c.smu.Unlock()
+
+	if c.started() {
+		c.watch(e.interval, e.reload)
+	}
+	return 0
+}
@@ -0,0 +1,34 @@
+package elastic
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnrichNested(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "assets.csv")
+	if err := os.WriteFile(file, []byte("ip,owner,hostname\n10.0.0.0/8,ops,intranet\n10.1.1.1,dev,web-01\n"), 0644); err != nil {
+		t.Fatalf("write csv fail %v", err)
+	}
+
+	e := &enrich{file: file, key: "ip", match: "source.ip", target: "host.asset"}
+	tab, err := e.load()
+	if err != nil {
+		t.Fatalf("enrich load fail %v", err)
+	}
+	e.table.Store(tab)
+
+	d := &doc{data: map[string]interface{}{"source": map[string]interface{}{"ip": "10.1.1.1"}}}
+	e.do(d)
+
+	want := map[string]interface{}{"asset": map[string]interface{}{"owner": "dev", "hostname": "web-01"}}
+	if !reflect.DeepEqual(d.data["host"], want) {
+		t.Errorf("enrich host = %#v want %#v", d.data["host"], want)
+	}
+
+	if _, ok := d.data["host.asset.owner"]; ok {
+		t.Errorf("enrich wrote a flat key")
+	}
+}
@@ -0,0 +1,386 @@
+package elastic
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	本地 GeoLite2 City/ASN 数据库补充地理位置和ASN 不占用集群的ingest资源
+	source.ip -> source.geo.* source.as.* 也可以用table指定写入的前缀
+	声明时打开数据库 文件变化后自动重新加载 客户端已经启动时(vela.elastic.default)立即开始检查
+
+	cli.geoip{
+		city     = "share/GeoLite2-City.mmdb",
+		asn      = "share/GeoLite2-ASN.mmdb",
+		fields   = {"source.ip" , "destination.ip"},  --或 {client_ip = "client"}
+		lang     = "en",
+		cache    = 8192,
+		interval = 60,
+	}
+*/
+
+type geoCity struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Continent struct {
+		Code  string            `maxminddb:"code"`
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"continent"`
+	Country struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+	Postal struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"postal"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+}
+
+type geoASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// mmdb 可以热替换的数据库文件
+type mmdb struct {
+	path  string
+	mu    sync.RWMutex
+	db    *maxminddb.Reader
+	mtime time.Time
+	size  int64
+}
+
+func (m *mmdb) open() error {
+	st, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+
+	db, err := maxminddb.Open(m.path)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	old := m.db
+	m.db = db
+	m.mtime = st.ModTime()
+	m.size = st.Size()
+	m.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// changed 按修改时间和大小判断 文件写到一半时下次再加载
+func (m *mmdb) changed() bool {
+	st, err := os.Stat(m.path)
+	if err != nil {
+		return false
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return !st.ModTime().Equal(m.mtime) || st.Size() != m.size
+}
+
+func (m *mmdb) lookup(ip net.IP, v interface{}) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.db == nil {
+		return fmt.Errorf("mmdb %s closed", m.path)
+	}
+	return m.db.Lookup(ip, v)
+}
+
+func (m *mmdb) close() {
+	m.mu.Lock()
+	if m.db != nil {
+		m.db.Close()
+		m.db = nil
+	}
+	m.mu.Unlock()
+}
+
+type geoip struct {
+	city     *mmdb
+	asn      *mmdb
+	fields   map[string]string
+	lang     string
+	interval time.Duration
+	cache    *lru
+
+	hit  uint64
+	miss uint64
+}
+
+func (g *geoip) name(names map[string]string) string {
+	if v, ok := names[g.lang]; ok {
+		return v
+	}
+	return names["en"]
+}
+
+// resolve 查询结果 key为相对于前缀的字段名
+func (g *geoip) resolve(ip net.IP) (map[string]interface{}, error) {
+	r := make(map[string]interface{})
+
+	if g.city != nil {
+		var c geoCity
+		if err := g.city.lookup(ip, &c); err != nil {
+			return nil, err
+		}
+
+		put := func(key, val string) {
+			if val != "" {
+				r[key] = val
+			}
+		}
+
+		put("geo.city_name", g.name(c.City.Names))
+		put("geo.continent_code", c.Continent.Code)
+		put("geo.continent_name", g.name(c.Continent.Names))
+		put("geo.country_iso_code", c.Country.IsoCode)
+		put("geo.country_name", g.name(c.Country.Names))
+		put("geo.timezone", c.Location.TimeZone)
+		put("geo.postal_code", c.Postal.Code)
+		if len(c.Subdivisions) > 0 {
+			put("geo.region_name", g.name(c.Subdivisions[0].Names))
+			if c.Subdivisions[0].IsoCode != "" && c.Country.IsoCode != "" {
+				put("geo.region_iso_code", c.Country.IsoCode+"-"+c.Subdivisions[0].IsoCode)
+			}
+		}
+
+		if c.Location.Latitude != 0 || c.Location.Longitude != 0 {
+			r["geo.location"] = map[string]interface{}{"lat": c.Location.Latitude, "lon": c.Location.Longitude}
+		}
+	}
+
+	if g.asn != nil {
+		var a geoASN
+		if err := g.asn.lookup(ip, &a); err != nil {
+			return nil, err
+		}
+
+		if a.Number > 0 {
+			r["as.number"] = a.Number
+		}
+		if a.Organization != "" {
+			r["as.organization.name"] = a.Organization
+		}
+	}
+
+	return r, nil
+}
+
+func (g *geoip) lookup(addr string) (map[string]interface{}, error) {
+	if v, ok := g.cache.get(addr); ok {
+		atomic.AddUint64(&g.hit, 1)
+		return v.(map[string]interface{}), nil
+	}
+	atomic.AddUint64(&g.miss, 1)
+
+	//不是ip的值同样缓存空结果
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		r := map[string]interface{}{}
+		g.cache.set(addr, r)
+		return r, nil
+	}
+
+	r, err := g.resolve(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	g.cache.set(addr, r)
+	return r, nil
+}
+
+func (g *geoip) do(d *doc) error {
+	for field, prefix := range g.fields {
+		v, ok := d.get(field)
+		if !ok {
+			continue
+		}
+
+		addr, ok := v.(string)
+		if !ok || addr == "" {
+			continue
+		}
+
+		r, err := g.lookup(addr)
+		if err != nil {
+			return err
+		}
+
+		for key, val := range r {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			d.data[key] = val
+		}
+	}
+	return nil
+}
+
+func (g *geoip) dbs() []*mmdb {
+	var v []*mmdb
+	if g.city != nil {
+		v = append(v, g.city)
+	}
+	if g.asn != nil {
+		v = append(v, g.asn)
+	}
+	return v
+}
+
+func (g *geoip) open() error {
+	for _, m := range g.dbs() {
+		if err := m.open(); err != nil {
+			return fmt.Errorf("geoip open %s fail %v", m.path, err)
+		}
+	}
+	return nil
+}
+
+// reload 文件变化后重新加载 清空缓存
+func (g *geoip) reload() {
+	reloaded := false
+	for _, m := range g.dbs() {
+		if !m.changed() {
+			continue
+		}
+
+		if err := m.open(); err != nil {
+			xEnv.Errorf("geoip reload %s fail %v", m.path, err)
+			continue
+		}
+		xEnv.Infof("geoip reload %s succeed", m.path)
+		reloaded = true
+	}
+
+	if reloaded {
+		g.cache.purge()
+	}
+}
+
+func (g *geoip) close() {
+	for _, m := range g.dbs() {
+		m.close()
+	}
+}
+
+// geoStage 启动后声明的geoip会在写入时被替换
+func (c *Client) geoStage() *geoip {
+	c.smu.RLock()
+	defer c.smu.RUnlock()
+	return c.geo
+}
+
+func (c *Client) DoGeoIP(d *doc) {
+	geo := c.geoStage()
+	if geo == nil {
+		return
+	}
+
+	if err := geo.do(d); err != nil {
+		xEnv.Errorf("%s %v", c.cfg.name(), err)
+	}
+}
+
+// geoPrefix source.ip -> source 没有'.'的字段写到顶层 geo.* as.*
+func geoPrefix(field string) string {
+	if i := strings.LastIndexByte(field, '.'); i > 0 {
+		return field[:i]
+	}
+	return ""
+}
+
+func (c *Client) geoipL(L *lua.LState) int {
+	tab := L.CheckTable(1)
+	g := &geoip{lang: "en", interval: time.Minute, fields: make(map[string]string)}
+	size := 4096
+
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "city":
+			g.city = &mmdb{path: val.String()}
+		case "asn":
+			g.asn = &mmdb{path: val.String()}
+		case "lang":
+			g.lang = val.String()
+		case "cache":
+			size = lua.CheckInt(L, val)
+		case "interval":
+			g.interval = time.Duration(lua.CheckInt(L, val)) * time.Second
+		case "fields":
+			switch v := val.(type) {
+			case lua.LString:
+				g.fields[v.String()] = geoPrefix(v.String())
+			case *lua.LTable:
+				for i := 1; i <= v.Len(); i++ {
+					field := v.RawGetInt(i).String()
+					g.fields[field] = geoPrefix(field)
+				}
+
+				v.Range(func(field string, prefix lua.LValue) {
+					g.fields[field] = prefix.String()
+				})
+			default:
+				L.RaiseError("invalid geoip fields , got %s", val.Type().String())
+			}
+		}
+	})
+
+	if g.city == nil && g.asn == nil {
+		L.RaiseError("geoip need city or asn database")
+		return 0
+	}
+
+	if len(g.fields) == 0 {
+		L.RaiseError("geoip need fields")
+		return 0
+	}
+
+	if c.geo != nil {
+		L.RaiseError("%s geoip already declared", c.cfg.name())
+		return 0
+	}
+
+	g.cache = newLRU(size, 0)
+	if err := g.open(); err != nil {
+		g.close()
+		L.RaiseError("%s %v", c.cfg.name(), err)
+		return 0
+	}
+
+	c.smu.Lock()
+	c.geo = g
+	c.smu.Unlock()
+
+	if c.started() {
+		c.watch(g.interval, g.reload)
+	}
+	return 0
+}
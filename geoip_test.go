@@ -0,0 +1,237 @@
+package elastic
+
+import (
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/vela-ssoc/vela-kit/vela"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testEnv struct {
+	vela.Environment
+}
+
+func (testEnv) Infof(string, ...interface{})  {}
+func (testEnv) Errorf(string, ...interface{}) {}
+
+// writeMMDB 生成测试用的mmdb文件 和更新数据库一样先写临时文件再替换
+func writeMMDB(t *testing.T, path string, kind string, records map[string]mmdbtype.Map) {
+	t.Helper()
+
+	w, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: kind, RecordSize: 24})
+	if err != nil {
+		t.Fatalf("mmdb writer fail %v", err)
+	}
+
+	for cidr, rec := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("invalid cidr %s", cidr)
+		}
+
+		if err = w.Insert(network, rec); err != nil {
+			t.Fatalf("mmdb insert %s fail %v", cidr, err)
+		}
+	}
+
+	fd, err := os.Create(path + ".tmp")
+	if err != nil {
+		t.Fatalf("create %s fail %v", path, err)
+	}
+
+	if _, err = w.WriteTo(fd); err != nil {
+		fd.Close()
+		t.Fatalf("write %s fail %v", path, err)
+	}
+	fd.Close()
+
+	if err = os.Rename(path+".tmp", path); err != nil {
+		t.Fatalf("rename %s fail %v", path, err)
+	}
+}
+
+func cityRecord(city, country string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"city": mmdbtype.Map{
+			"names": mmdbtype.Map{"en": mmdbtype.String(city), "zh-CN": mmdbtype.String(city + "-zh")},
+		},
+		"continent": mmdbtype.Map{
+			"code":  mmdbtype.String("EU"),
+			"names": mmdbtype.Map{"en": mmdbtype.String("Europe")},
+		},
+		"country": mmdbtype.Map{
+			"iso_code": mmdbtype.String(country),
+			"names":    mmdbtype.Map{"en": mmdbtype.String("United Kingdom")},
+		},
+		"location": mmdbtype.Map{
+			"latitude":  mmdbtype.Float64(51.5142),
+			"longitude": mmdbtype.Float64(-0.0931),
+			"time_zone": mmdbtype.String("Europe/London"),
+		},
+		"subdivisions": mmdbtype.Slice{
+			mmdbtype.Map{
+				"iso_code": mmdbtype.String("ENG"),
+				"names":    mmdbtype.Map{"en": mmdbtype.String("England")},
+			},
+		},
+	}
+}
+
+func asnRecord(number uint32, org string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(number),
+		"autonomous_system_organization": mmdbtype.String(org),
+	}
+}
+
+func newTestGeoIP(t *testing.T, dir string) *geoip {
+	t.Helper()
+
+	city := filepath.Join(dir, "city.mmdb")
+	asn := filepath.Join(dir, "asn.mmdb")
+	writeMMDB(t, city, "GeoLite2-City", map[string]mmdbtype.Map{"81.2.69.0/24": cityRecord("London", "GB")})
+	writeMMDB(t, asn, "GeoLite2-ASN", map[string]mmdbtype.Map{"81.2.69.0/24": asnRecord(20712, "Andrews & Arnold Ltd")})
+
+	g := &geoip{
+		city:   &mmdb{path: city},
+		asn:    &mmdb{path: asn},
+		fields: map[string]string{"source.ip": "source", "client_ip": ""},
+		lang:   "en",
+		cache:  newLRU(16, 0),
+	}
+
+	if err := g.open(); err != nil {
+		t.Fatalf("geoip open fail %v", err)
+	}
+	t.Cleanup(g.close)
+	return g
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	g := newTestGeoIP(t, t.TempDir())
+
+	d := &doc{data: map[string]interface{}{"source.ip": "81.2.69.142", "client_ip": "81.2.69.1"}}
+	if err := g.do(d); err != nil {
+		t.Fatalf("geoip do fail %v", err)
+	}
+
+	want := map[string]interface{}{
+		"source.geo.city_name":        "London",
+		"source.geo.continent_code":   "EU",
+		"source.geo.continent_name":   "Europe",
+		"source.geo.country_iso_code": "GB",
+		"source.geo.country_name":     "United Kingdom",
+		"source.geo.region_name":      "England",
+		"source.geo.region_iso_code":  "GB-ENG",
+		"source.geo.timezone":         "Europe/London",
+		"source.geo.location":         map[string]interface{}{"lat": 51.5142, "lon": -0.0931},
+		"source.as.number":            uint(20712),
+		"source.as.organization.name": "Andrews & Arnold Ltd",
+		"geo.city_name":               "London",
+		"as.number":                   uint(20712),
+	}
+
+	for key, val := range want {
+		if !reflect.DeepEqual(d.data[key], val) {
+			t.Errorf("geoip %s = %#v want %#v", key, d.data[key], val)
+		}
+	}
+
+	if _, ok := d.data["source.geo.postal_code"]; ok {
+		t.Errorf("geoip empty postal_code should be absent")
+	}
+}
+
+func TestGeoIPLang(t *testing.T) {
+	g := newTestGeoIP(t, t.TempDir())
+	g.lang = "zh-CN"
+
+	r, err := g.lookup("81.2.69.142")
+	if err != nil {
+		t.Fatalf("geoip lookup fail %v", err)
+	}
+
+	if r["geo.city_name"] != "London-zh" {
+		t.Errorf("geoip zh-CN city = %v", r["geo.city_name"])
+	}
+
+	//没有对应语言时回退到en
+	if r["geo.country_name"] != "United Kingdom" {
+		t.Errorf("geoip fallback country = %v", r["geo.country_name"])
+	}
+}
+
+func TestGeoIPCache(t *testing.T) {
+	g := newTestGeoIP(t, t.TempDir())
+
+	for _, addr := range []string{"81.2.69.142", "81.2.69.142", "10.0.0.1", "not-an-ip", "not-an-ip"} {
+		if _, err := g.lookup(addr); err != nil {
+			t.Fatalf("geoip lookup %s fail %v", addr, err)
+		}
+	}
+
+	if g.hit != 2 || g.miss != 3 {
+		t.Errorf("geoip cache hit=%d miss=%d want hit=2 miss=3", g.hit, g.miss)
+	}
+
+	r, _ := g.lookup("10.0.0.1")
+	if len(r) != 0 {
+		t.Errorf("geoip unknown address = %v want empty", r)
+	}
+}
+
+func TestGeoIPReload(t *testing.T) {
+	xEnv = testEnv{}
+
+	dir := t.TempDir()
+	g := newTestGeoIP(t, dir)
+
+	r, err := g.lookup("81.2.69.142")
+	if err != nil || r["geo.city_name"] != "London" {
+		t.Fatalf("geoip lookup = %v , %v", r, err)
+	}
+
+	//文件没有变化时不重新加载 缓存保留
+	g.reload()
+	if _, ok := g.cache.get("81.2.69.142"); !ok {
+		t.Fatalf("geoip reload without change purged the cache")
+	}
+
+	writeMMDB(t, g.city.path, "GeoLite2-City", map[string]mmdbtype.Map{"81.2.69.0/24": cityRecord("Manchester", "GB")})
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(g.city.path, future, future); err != nil {
+		t.Fatalf("chtimes fail %v", err)
+	}
+
+	g.reload()
+	if _, ok := g.cache.get("81.2.69.142"); ok {
+		t.Fatalf("geoip reload kept the stale cache")
+	}
+
+	r, err = g.lookup("81.2.69.142")
+	if err != nil || r["geo.city_name"] != "Manchester" {
+		t.Errorf("geoip after reload = %v , %v want Manchester", r, err)
+	}
+
+	//文件损坏时继续使用已加载的数据库
+	broken := g.city.path + ".broken"
+	if err = os.WriteFile(broken, []byte("broken"), 0644); err != nil {
+		t.Fatalf("write broken mmdb fail %v", err)
+	}
+
+	if err = os.Rename(broken, g.city.path); err != nil {
+		t.Fatalf("rename broken mmdb fail %v", err)
+	}
+
+	g.reload()
+	g.cache.purge()
+	r, err = g.lookup("81.2.69.142")
+	if err != nil || r["geo.city_name"] != "Manchester" {
+		t.Errorf("geoip after broken reload = %v , %v want Manchester", r, err)
+	}
+}
@@ -0,0 +1,279 @@
+package elastic
+
+import (
+	"fmt"
+	cond "github.com/vela-ssoc/vela-cond"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"regexp"
+	"strconv"
+)
+
+/*
+	从非结构化字段中提取字段 多个pattern按顺序尝试 第一个匹配的生效
+	%{PATTERN:field} %{PATTERN:field:int} %{PATTERN:field:float}
+	全部不匹配时打上tag 默认 _grokparsefailure
+	pattern在声明时编译 vela.elastic.default() 已经启动后声明同样生效
+
+	cli.grok("message" , "%{IP:client} %{WORD:method} %{URIPATHPARAM:request} %{NUMBER:bytes:int}")
+	cli.grok("message" , "%{MYAPP:app} %{GREEDYDATA:msg}" , "%{GREEDYDATA:msg}" , {
+		patterns = {MYAPP = "[a-z]+-[0-9]+"},
+		tag      = "_app_grok_fail",
+		cond     = "app = nginx",
+	})
+*/
+
+const grokFailure = "_grokparsefailure"
+
+// 内置pattern 兼容RE2 不支持环视
+var grokBuiltin = map[string]string{
+	"USERNAME":       `[a-zA-Z0-9._-]+`,
+	"USER":           `%{USERNAME}`,
+	"EMAILLOCALPART": `[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(?:\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*`,
+	"EMAILADDRESS":   `%{EMAILLOCALPART}@%{HOSTNAME}`,
+	"INT":            `[+-]?[0-9]+`,
+	"BASE10NUM":      `[+-]?(?:[0-9]+(?:\.[0-9]+)?|\.[0-9]+)`,
+	"NUMBER":         `%{BASE10NUM}`,
+	"BASE16NUM":      `[+-]?(?:0x)?[0-9A-Fa-f]+`,
+	"POSINT":         `[1-9][0-9]*`,
+	"NONNEGINT":      `[0-9]+`,
+	"WORD":           `\b\w+\b`,
+	"NOTSPACE":       `\S+`,
+	"SPACE":          `\s*`,
+	"DATA":           `.*?`,
+	"GREEDYDATA":     `.*`,
+	"QUOTEDSTRING":   `"(?:[^"\\]|\\.)*"|'(?:[^'\\]|\\.)*'`,
+	"UUID":           `[A-Fa-f0-9]{8}-(?:[A-Fa-f0-9]{4}-){3}[A-Fa-f0-9]{12}`,
+	"MAC":            `(?:[A-Fa-f0-9]{2}[:-]){5}[A-Fa-f0-9]{2}|(?:[A-Fa-f0-9]{4}\.){2}[A-Fa-f0-9]{4}`,
+	"IPV4":           `(?:(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])\.){3}(?:25[0-5]|2[0-4][0-9]|1[0-9]{2}|[1-9]?[0-9])`,
+	"IPV6":           `(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{1,4}:){1,7}:|(?:[0-9A-Fa-f]{1,4}:){1,6}:[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{1,4}:){1,5}(?::[0-9A-Fa-f]{1,4}){1,2}|(?:[0-9A-Fa-f]{1,4}:){1,4}(?::[0-9A-Fa-f]{1,4}){1,3}|(?:[0-9A-Fa-f]{1,4}:){1,3}(?::[0-9A-Fa-f]{1,4}){1,4}|(?:[0-9A-Fa-f]{1,4}:){1,2}(?::[0-9A-Fa-f]{1,4}){1,5}|[0-9A-Fa-f]{1,4}:(?::[0-9A-Fa-f]{1,4}){1,6}|:(?:(?::[0-9A-Fa-f]{1,4}){1,7}|:)|::(?:[Ff]{4}:)?%{IPV4}`,
+	"IP":             `%{IPV6}|%{IPV4}`,
+	"HOSTNAME":       `\b[0-9A-Za-z][0-9A-Za-z-]{0,62}(?:\.[0-9A-Za-z][0-9A-Za-z-]{0,62})*\.?\b`,
+	"IPORHOST":       `%{IP}|%{HOSTNAME}`,
+	"HOSTPORT":       `%{IPORHOST}:%{POSINT}`,
+	"UNIXPATH":       `(?:/[^/\s?#]*)+`,
+	"WINPATH":        `(?:[A-Za-z]+:|\\)(?:\\[^\\?*]*)+`,
+	"PATH":           `%{UNIXPATH}|%{WINPATH}`,
+	"URIPROTO":       `[A-Za-z][A-Za-z0-9+\-.]*`,
+	"URIHOST":        `%{IPORHOST}(?::%{POSINT})?`,
+	"URIPATH":        `(?:/[A-Za-z0-9$.+!*'(){},~:;=@#%&_\-]*)+`,
+	"URIPARAM":       `\?[A-Za-z0-9$.+!*'|(){},~@#%&/=:;_?\-\[\]<>]*`,
+	"URIPATHPARAM":   `%{URIPATH}(?:%{URIPARAM})?`,
+	"URI":            `%{URIPROTO}://(?:%{USER}(?::[^@]*)?@)?(?:%{URIHOST})?(?:%{URIPATHPARAM})?`,
+
+	"MONTH":             `\b(?:[Jj]an(?:uary)?|[Ff]eb(?:ruary)?|[Mm]ar(?:ch)?|[Aa]pr(?:il)?|[Mm]ay|[Jj]une?|[Jj]uly?|[Aa]ug(?:ust)?|[Ss]ep(?:tember)?|[Oo]ct(?:ober)?|[Nn]ov(?:ember)?|[Dd]ec(?:ember)?)\b`,
+	"MONTHNUM":          `0?[1-9]|1[0-2]`,
+	"MONTHDAY":          `(?:0[1-9])|(?:[12][0-9])|(?:3[01])|[1-9]`,
+	"DAY":               `(?:Mon(?:day)?|Tue(?:sday)?|Wed(?:nesday)?|Thu(?:rsday)?|Fri(?:day)?|Sat(?:urday)?|Sun(?:day)?)`,
+	"YEAR":              `[0-9]{4}|[0-9]{2}`,
+	"HOUR":              `2[0123]|[01]?[0-9]`,
+	"MINUTE":            `[0-5][0-9]`,
+	"SECOND":            `(?:[0-5]?[0-9]|60)(?:[:.,][0-9]+)?`,
+	"TIME":              `%{HOUR}:%{MINUTE}(?::%{SECOND})?`,
+	"DATE_US":           `%{MONTHNUM}[/-]%{MONTHDAY}[/-]%{YEAR}`,
+	"DATE_EU":           `%{MONTHDAY}[./-]%{MONTHNUM}[./-]%{YEAR}`,
+	"ISO8601_TIMEZONE":  `Z|[+-]%{HOUR}(?::?%{MINUTE})`,
+	"TIMESTAMP_ISO8601": `%{YEAR}-%{MONTHNUM}-%{MONTHDAY}[T ]%{HOUR}:?%{MINUTE}(?::?%{SECOND})?(?:%{ISO8601_TIMEZONE})?`,
+	"HTTPDATE":          `%{MONTHDAY}/%{MONTH}/%{YEAR}:%{TIME} %{INT}`,
+	"SYSLOGTIMESTAMP":   `%{MONTH} +%{MONTHDAY} %{TIME}`,
+	"LOGLEVEL":          `[Aa]lert|ALERT|[Tt]race|TRACE|[Dd]ebug|DEBUG|[Nn]otice|NOTICE|[Ii]nfo|INFO|[Ww]arn(?:ing)?|WARN(?:ING)?|[Ee]rr(?:or)?|ERR(?:OR)?|[Cc]rit(?:ical)?|CRIT(?:ICAL)?|[Ff]atal|FATAL|[Ss]evere|SEVERE|EMERG(?:ENCY)?|[Ee]merg(?:ency)?`,
+
+	"SYSLOGPROG":        `%{DATA:process.name}(?:\[%{POSINT:process.pid:int}\])?`,
+	"SYSLOGBASE":        `%{SYSLOGTIMESTAMP:timestamp} %{IPORHOST:host.hostname} %{SYSLOGPROG}:`,
+	"COMMONAPACHELOG":   `%{IPORHOST:source.address} %{NOTSPACE:ident} %{NOTSPACE:user.name} \[%{HTTPDATE:timestamp}\] "(?:%{WORD:http.request.method} %{NOTSPACE:url.original}(?: HTTP/%{NUMBER:http.version})?|%{DATA:rawrequest})" %{NUMBER:http.response.status_code:int} (?:%{NUMBER:http.response.body.bytes:int}|-)`,
+	"COMBINEDAPACHELOG": `%{COMMONAPACHELOG} %{QUOTEDSTRING:http.request.referrer} %{QUOTEDSTRING:user_agent.original}`,
+}
+
+var grokToken = regexp.MustCompile(`%\{(\w+)(?::([^:}]+))?(?::(int|float))?\}`)
+
+type grokField struct {
+	name string
+	typ  string
+}
+
+type grokExpr struct {
+	re     *regexp.Regexp
+	fields map[string]grokField
+}
+
+type grok struct {
+	field    string
+	patterns []string
+	custom   map[string]string
+	tag      string
+	cnd      *cond.Cond
+	exprs    []*grokExpr
+}
+
+// expand 递归展开 %{NAME:field} 命名的捕获组换成 g1 g2 ... 字段名另外记录
+func (g *grok) expand(pattern string, expr *grokExpr, depth int) (string, error) {
+	if depth > 32 {
+		return "", fmt.Errorf("grok pattern nested too deep")
+	}
+
+	var err error
+	out := grokToken.ReplaceAllStringFunc(pattern, func(token string) string {
+		if err != nil {
+			return ""
+		}
+
+		m := grokToken.FindStringSubmatch(token)
+		name, field, typ := m[1], m[2], m[3]
+
+		def, ok := g.custom[name]
+		if !ok {
+			def, ok = grokBuiltin[name]
+		}
+		if !ok {
+			err = fmt.Errorf("grok pattern %s not found", name)
+			return ""
+		}
+
+		sub, e := g.expand(def, expr, depth+1)
+		if e != nil {
+			err = e
+			return ""
+		}
+
+		if field == "" {
+			return "(?:" + sub + ")"
+		}
+
+		group := "g" + strconv.Itoa(len(expr.fields)+1)
+		expr.fields[group] = grokField{name: field, typ: typ}
+		return "(?P<" + group + ">" + sub + ")"
+	})
+
+	return out, err
+}
+
+func (g *grok) compile() error {
+	g.exprs = nil
+	for _, pattern := range g.patterns {
+		expr := &grokExpr{fields: make(map[string]grokField)}
+		raw, err := g.expand(pattern, expr, 0)
+		if err != nil {
+			return err
+		}
+
+		re, err := regexp.Compile(raw)
+		if err != nil {
+			return fmt.Errorf("grok compile %s fail %v", pattern, err)
+		}
+		expr.re = re
+		g.exprs = append(g.exprs, expr)
+	}
+	return nil
+}
+
+func (e *grokExpr) match(d *doc, s string) bool {
+	m := e.re.FindStringSubmatch(s)
+	if m == nil {
+		return false
+	}
+
+	for i, group := range e.re.SubexpNames() {
+		f, ok := e.fields[group]
+		if !ok || m[i] == "" {
+			continue
+		}
+
+		switch f.typ {
+		case ConvertInt, ConvertFloat:
+			v, err := convert(m[i], f.typ)
+			if err != nil {
+				d.set(f.name, m[i])
+				continue
+			}
+			d.set(f.name, v)
+		default:
+			d.set(f.name, m[i])
+		}
+	}
+	return true
+}
+
+func (g *grok) do(d *doc) {
+	if g.cnd != nil && !g.cnd.Match(d) {
+		return
+	}
+
+	v, ok := d.get(g.field)
+	if !ok {
+		return
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return
+	}
+
+	for _, e := range g.exprs {
+		if e.match(d, s) {
+			return
+		}
+	}
+	tag(d, g.tag)
+}
+
+func (c *Client) DoGrok(d *doc) {
+	c.smu.RLock()
+	groks := c.groks
+	c.smu.RUnlock()
+
+	for _, g := range groks {
+		g.do(d)
+	}
+}
+
+func (c *Client) grokL(L *lua.LState) int {
+	n := L.GetTop()
+	g := &grok{field: L.CheckString(1), tag: grokFailure, custom: make(map[string]string)}
+
+	for i := 2; i <= n; i++ {
+		val := L.Get(i)
+		switch val.Type() {
+		case lua.LTString:
+			g.patterns = append(g.patterns, val.String())
+
+		case lua.LTTable:
+			val.(*lua.LTable).Range(func(key string, v lua.LValue) {
+				switch key {
+				case "patterns":
+					tab, ok := v.(*lua.LTable)
+					if !ok {
+						L.RaiseError("invalid grok patterns , got %s", v.Type().String())
+						return
+					}
+					tab.Range(func(name string, def lua.LValue) {
+						g.custom[name] = def.String()
+					})
+				case "tag":
+					g.tag = v.String()
+				case "cond":
+					g.cnd = checkCond(L, v)
+				}
+			})
+
+		default:
+			L.RaiseError("invalid grok pattern , got %s", val.Type().String())
+			return 0
+		}
+	}
+
+	if len(g.patterns) == 0 {
+		L.RaiseError("grok %s need pattern", g.field)
+		return 0
+	}
+
+	//声明时编译 错误的pattern直接报错 不会带着错误的pattern运行
+	if err := g.compile(); err != nil {
+		L.RaiseError("%s %v", c.cfg.name(), err)
+		return 0
+	}
+
+	//vela.elastic.default() 已经启动 写入的goroutine正在读取 复制后替换
+	c.smu.Lock()
+	c.groks = append(c.groks[:len(c.groks):len(c.groks)], g)
+	c.smu.Unlock()
+	return 0
+}
@@ -0,0 +1,95 @@
+package elastic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGrokMatch(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		custom   map[string]string
+		message  string
+		want     map[string]interface{}
+	}{
+		{
+			patterns: []string{"%{IP:client} %{WORD:method} %{URIPATHPARAM:request} %{NUMBER:bytes:int} %{NUMBER:duration:float}"},
+			message:  "55.3.244.1 GET /index.html?a=1 15824 0.043",
+			want: map[string]interface{}{
+				"client":   "55.3.244.1",
+				"method":   "GET",
+				"request":  "/index.html?a=1",
+				"bytes":    int64(15824),
+				"duration": 0.043,
+			},
+		},
+		{
+			patterns: []string{"%{SYSLOGBASE} %{GREEDYDATA:msg}"},
+			message:  "Oct 11 22:14:15 web01 sshd[230]: Accepted publickey for root",
+			want: map[string]interface{}{
+				"timestamp":     "Oct 11 22:14:15",
+				"host.hostname": "web01",
+				"process.name":  "sshd",
+				"process.pid":   int64(230),
+				"msg":           "Accepted publickey for root",
+			},
+		},
+		{
+			patterns: []string{"%{MYAPP:app} %{LOGLEVEL:level}", "%{GREEDYDATA:msg}"},
+			custom:   map[string]string{"MYAPP": "[a-z]+-[0-9]+"},
+			message:  "billing-42 WARN",
+			want:     map[string]interface{}{"app": "billing-42", "level": "WARN"},
+		},
+		{
+			patterns: []string{"%{MYAPP:app} %{LOGLEVEL:level}", "%{GREEDYDATA:msg}"},
+			custom:   map[string]string{"MYAPP": "[a-z]+-[0-9]+"},
+			message:  "no app here",
+			want:     map[string]interface{}{"msg": "no app here"},
+		},
+	}
+
+	for _, c := range cases {
+		g := &grok{field: "message", patterns: c.patterns, custom: c.custom, tag: grokFailure}
+		if err := g.compile(); err != nil {
+			t.Fatalf("grok compile %v fail %v", c.patterns, err)
+		}
+
+		d := &doc{data: map[string]interface{}{"message": c.message}}
+		g.do(d)
+
+		if _, ok := d.data["tags"]; ok {
+			t.Errorf("grok %q tagged %v", c.message, d.data["tags"])
+		}
+
+		for field, want := range c.want {
+			got, _ := d.get(field)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("grok %q field %s = %#v want %#v", c.message, field, got, want)
+			}
+		}
+	}
+}
+
+func TestGrokFailure(t *testing.T) {
+	g := &grok{field: "message", patterns: []string{"%{IP:client}"}, tag: "_custom_fail"}
+	if err := g.compile(); err != nil {
+		t.Fatalf("grok compile fail %v", err)
+	}
+
+	d := &doc{data: map[string]interface{}{"message": "not an address", "tags": "old"}}
+	g.do(d)
+
+	want := []interface{}{"old", "_custom_fail"}
+	if !reflect.DeepEqual(d.data["tags"], want) {
+		t.Errorf("grok failure tags = %v want %v", d.data["tags"], want)
+	}
+}
+
+func TestGrokCompileError(t *testing.T) {
+	for _, pattern := range []string{"%{NOPE:x}", "%{LOOP}", "(%{WORD:x}"} {
+		g := &grok{field: "message", patterns: []string{pattern}, custom: map[string]string{"LOOP": "%{LOOP}"}}
+		if err := g.compile(); err == nil {
+			t.Errorf("grok compile %q want error", pattern)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package elastic
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	索引模板
+	app-${service|lower|default:unknown}-${@timestamp|date:2006.01}
+	过滤器:
+		lower upper trim
+		default:val          字段缺失或为空时使用
+		replace:old:new
+		truncate:n
+		hash_mod:n           fnv32 取模 用于分片
+		date:layout          按时间格式化 @timestamp使用事件时间
+		sanitize             非法字符替换为_
+*/
+
+type tplFilter struct {
+	name string
+	args []string
+}
+
+type tplPart struct {
+	literal string
+	field   string
+	filters []tplFilter
+}
+
+type indexTemplate struct {
+	raw   string
+	parts []tplPart
+}
+
+func parseIndexTemplate(raw string) (*indexTemplate, error) {
+	tpl := &indexTemplate{raw: raw}
+
+	rest := raw
+	for len(rest) > 0 {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			tpl.parts = append(tpl.parts, tplPart{literal: rest})
+			break
+		}
+
+		if start > 0 {
+			tpl.parts = append(tpl.parts, tplPart{literal: rest[:start]})
+		}
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("index template %s missing '}'", raw)
+		}
+
+		expr := rest[start+2 : start+end]
+		rest = rest[start+end+1:]
+
+		items := strings.Split(expr, "|")
+		part := tplPart{field: strings.TrimSpace(items[0])}
+		if part.field == "" {
+			return nil, fmt.Errorf("index template %s empty field", raw)
+		}
+
+		for _, item := range items[1:] {
+			args := strings.Split(strings.TrimSpace(item), ":")
+			f := tplFilter{name: strings.ReplaceAll(args[0], "-", "_"), args: args[1:]}
+			if err := f.check(); err != nil {
+				return nil, fmt.Errorf("index template %s %v", raw, err)
+			}
+			part.filters = append(part.filters, f)
+		}
+
+		tpl.parts = append(tpl.parts, part)
+	}
+
+	return tpl, nil
+}
+
+func (f tplFilter) check() error {
+	need := 0
+	switch f.name {
+	case "lower", "upper", "trim", "sanitize":
+	case "default", "truncate", "hash_mod":
+		need = 1
+	case "date":
+		// date:2006.01.02 格式里可能包含':'
+		if len(f.args) == 0 {
+			return fmt.Errorf("filter date need layout")
+		}
+		return nil
+	case "replace":
+		need = 2
+	default:
+		return fmt.Errorf("unknown filter %s", f.name)
+	}
+
+	if len(f.args) < need {
+		return fmt.Errorf("filter %s need %d args", f.name, need)
+	}
+
+	if f.name == "truncate" || f.name == "hash_mod" {
+		n, err := strconv.Atoi(f.args[0])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("filter %s invalid number %s", f.name, f.args[0])
+		}
+	}
+	return nil
+}
+
+// indexFallback 格式中没有可用前缀时的fallback索引
+const indexFallback = "vela-fallback"
+
+var indexSanitizer = strings.NewReplacer(
+	"\\", "_", "/", "_", "*", "_", "?", "_", "\"", "_", "<", "_",
+	">", "_", "|", "_", " ", "_", ",", "_", "#", "_", ":", "_")
+
+func (f tplFilter) apply(d *doc, field string, raw interface{}, v string) string {
+	switch f.name {
+	case "lower":
+		return strings.ToLower(v)
+	case "upper":
+		return strings.ToUpper(v)
+	case "trim":
+		return strings.TrimSpace(v)
+	case "sanitize":
+		return indexSanitizer.Replace(v)
+	case "default":
+		if v == "" {
+			return f.args[0]
+		}
+		return v
+	case "replace":
+		return strings.ReplaceAll(v, f.args[0], f.args[1])
+	case "truncate":
+		n, _ := strconv.Atoi(f.args[0])
+		if len(v) > n {
+			return v[:n]
+		}
+		return v
+	case "hash_mod":
+		n, _ := strconv.Atoi(f.args[0])
+		h := fnv.New32a()
+		h.Write([]byte(v))
+		return strconv.Itoa(int(h.Sum32() % uint32(n)))
+	case "date":
+		layout := strings.Join(f.args, ":")
+		t, ok := d.eventTime(field, raw)
+		if !ok {
+			return ""
+		}
+		return t.Format(layout)
+	}
+	return v
+}
+
+// eventTime @timestamp使用解析后的事件时间 其他字段按RFC3339解析
+func (d *doc) eventTime(field string, raw interface{}) (time.Time, bool) {
+	if field == "@timestamp" && !d.ts.IsZero() {
+		return d.time(), true
+	}
+
+	var t time.Time
+	switch v := raw.(type) {
+	case time.Time:
+		t = v
+	case string:
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return t, false
+		}
+	default:
+		return t, false
+	}
+
+	if d.loc == nil {
+		return t.UTC(), true
+	}
+	return t.In(d.loc), true
+}
+
+func (tpl *indexTemplate) render(d *doc) (string, error) {
+	var buf strings.Builder
+
+	for _, p := range tpl.parts {
+		if p.field == "" {
+			buf.WriteString(p.literal)
+			continue
+		}
+
+		raw := d.v(p.field)
+		v := ""
+		if raw != nil {
+			v = d.Field(p.field)
+		}
+
+		for _, f := range p.filters {
+			v = f.apply(d, p.field, raw, v)
+		}
+
+		if v == "" {
+			return "", fmt.Errorf("index field %s empty", p.field)
+		}
+		buf.WriteString(v)
+	}
+
+	return buf.String(), nil
+}
+
+// validIndex Elasticsearch 索引命名规则
+func validIndex(name string) error {
+	if name == "" {
+		return fmt.Errorf("index name empty")
+	}
+
+	if name == "." || name == ".." {
+		return fmt.Errorf("index name %s invalid", name)
+	}
+
+	if len(name) > 255 {
+		return fmt.Errorf("index name %s longer than 255 bytes", name)
+	}
+
+	switch name[0] {
+	case '-', '_', '+':
+		return fmt.Errorf("index name %s must not start with %c", name, name[0])
+	}
+
+	if name != strings.ToLower(name) {
+		return fmt.Errorf("index name %s must be lowercase", name)
+	}
+
+	if strings.ContainsAny(name, "\\/*?\"<>| ,#:") {
+		return fmt.Errorf("index name %s contains invalid character", name)
+	}
+
+	return nil
+}
+
+func PrepareIndexTemplate(raw string) (func(*doc) error, error) {
+	tpl, err := parseIndexTemplate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(d *doc) error {
+		name, err := tpl.render(d)
+		if err != nil {
+			d.index = ""
+			return err
+		}
+
+		d.index = name
+		return nil
+	}, nil
+}
+
+// DoFallback 索引渲染失败或不合法时使用index_fallback 未配置时使用默认的fallback索引
+func (c *Client) DoFallback(d *doc) error {
+	err := validIndex(d.index)
+	if err == nil {
+		return nil
+	}
+
+	name := c.cfg.IndexFallback
+	if name == "" {
+		format := c.format
+		if format == "" {
+			format = c.cfg.Index
+		}
+		name = fallbackIndex(format)
+	}
+
+	if e := validIndex(name); e != nil {
+		return fmt.Errorf("%v , fallback %v", err, e)
+	}
+
+	d.index = name
+	return nil
+}
+
+// fallbackIndex 取格式中第一个变量之前的部分加上-fallback
+// vela-es-%s -> vela-es-fallback  ${service}-logs -> vela-fallback
+func fallbackIndex(format string) string {
+	base := format
+	if i := strings.IndexByte(base, '%'); i >= 0 {
+		base = base[:i]
+	}
+
+	if i := strings.Index(base, "${"); i >= 0 {
+		base = base[:i]
+	}
+
+	base = strings.TrimRight(strings.ToLower(base), "-_.")
+	if base == "" || validIndex(base) != nil {
+		return indexFallback
+	}
+	return base + "-fallback"
+}
@@ -0,0 +1,49 @@
+package elastic
+
+import "testing"
+
+func TestFallbackIndex(t *testing.T) {
+	cases := []struct {
+		format string
+		want   string
+	}{
+		{format: "vela-es-%s", want: "vela-es-fallback"},
+		{format: "%s-app-%s", want: indexFallback},
+		{format: "App_Logs.%s", want: "app_logs-fallback"},
+		{format: "logs-${service|lower}-${@timestamp|date:2006.01}", want: "logs-fallback"},
+		{format: "${service}-logs", want: indexFallback},
+		{format: "_internal-%s", want: indexFallback},
+		{format: "", want: indexFallback},
+	}
+
+	for _, c := range cases {
+		if got := fallbackIndex(c.format); got != c.want {
+			t.Errorf("fallbackIndex(%q) = %q want %q", c.format, got, c.want)
+		}
+	}
+}
+
+func TestDoFallback(t *testing.T) {
+	c := &Client{cfg: &config{}, format: "vela-es-%s"}
+	render := PrepareIndex("vela-es-%s", []string{"$host"})
+
+	d := &doc{data: map[string]interface{}{}}
+	if err := render(d); err == nil {
+		t.Fatalf("render without host want error")
+	}
+
+	if err := c.DoFallback(d); err != nil || d.index != "vela-es-fallback" {
+		t.Errorf("default fallback = %q , %v want vela-es-fallback", d.index, err)
+	}
+
+	c.cfg.IndexFallback = "unrouted"
+	d = &doc{index: "Bad Index"}
+	if err := c.DoFallback(d); err != nil || d.index != "unrouted" {
+		t.Errorf("index_fallback = %q , %v want unrouted", d.index, err)
+	}
+
+	d = &doc{index: "vela-es-web"}
+	if err := c.DoFallback(d); err != nil || d.index != "vela-es-web" {
+		t.Errorf("valid index rewritten to %q , %v", d.index, err)
+	}
+}
@@ -0,0 +1,315 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/olivere/elastic/v7"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"github.com/vela-ssoc/vela-kit/strutil"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	按Elasticsearch中的索引补充字段 类似客户端的enrich processor
+	Write时不查询 线程发送bulk前对整批文档去重后一次查询 key为_id时走mget 否则走terms
+	结果带ttl缓存 没有找到的key同样缓存 查询失败时文档照常写入
+
+	cli.lookup{
+		index       = "users",
+		match_field = "user.name",
+		key         = "uid",                  --索引中的字段 默认_id
+		fields      = {"department" , "title"},
+		target      = "user",                 --写入 user.department 默认写到顶层
+		ttl         = 300,
+		cache       = 10000,
+		timeout     = 5,
+	}
+*/
+
+const lookupBatch = 1000
+
+type esLookup struct {
+	index   string
+	match   string
+	key     string
+	fields  []string
+	target  string
+	timeout time.Duration
+	cache   *lru
+
+	hit     uint64
+	miss    uint64
+	queries uint64
+	errors  uint64
+}
+
+// fetch 查询缓存中没有的key 返回 key -> source 没有找到的key值为nil
+func (lk *esLookup) fetch(ctx context.Context, cli *elastic.Client, keys []string) (map[string]map[string]interface{}, error) {
+	found := make(map[string]map[string]interface{}, len(keys))
+	fsc := elastic.NewFetchSourceContext(true)
+	if len(lk.fields) > 0 {
+		include := append([]string{}, lk.fields...)
+		if lk.key != "_id" {
+			include = append(include, lk.key)
+		}
+		fsc.Include(include...)
+	}
+
+	decode := func(raw json.RawMessage) map[string]interface{} {
+		var m map[string]interface{}
+		if len(raw) == 0 || json.Unmarshal(raw, &m) != nil {
+			return nil
+		}
+		return m
+	}
+
+	for i := 0; i < len(keys); i += lookupBatch {
+		end := i + lookupBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		chunk := keys[i:end]
+		atomic.AddUint64(&lk.queries, 1)
+
+		if lk.key == "_id" {
+			svc := cli.Mget()
+			for _, key := range chunk {
+				svc.Add(elastic.NewMultiGetItem().Index(lk.index).Id(key).FetchSource(fsc))
+			}
+
+			rsp, err := svc.Do(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, item := range rsp.Docs {
+				if item.Found {
+					found[item.Id] = decode(item.Source)
+				}
+			}
+			continue
+		}
+
+		vals := make([]interface{}, len(chunk))
+		for j, key := range chunk {
+			vals[j] = key
+		}
+
+		rsp, err := cli.Search(lk.index).
+			Query(elastic.NewTermsQuery(lk.key, vals...)).
+			FetchSourceContext(fsc).
+			Size(len(chunk)).
+			Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if rsp.Hits == nil {
+			continue
+		}
+
+		for _, hit := range rsp.Hits.Hits {
+			m := decode(hit.Source)
+			if m == nil {
+				continue
+			}
+
+			src, k, ok := lookup(m, lk.key)
+			if ok {
+				found[strutil.String(src[k])] = m
+			}
+		}
+	}
+
+	return found, nil
+}
+
+func (lk *esLookup) apply(d *doc, src map[string]interface{}) {
+	put := func(key string, val interface{}) {
+		if lk.target != "" {
+			key = lk.target + "." + key
+		}
+		d.set(key, val)
+	}
+
+	if len(lk.fields) == 0 {
+		for key, val := range src {
+			if key != lk.key {
+				put(key, val)
+			}
+		}
+		return
+	}
+
+	for _, key := range lk.fields {
+		if m, k, ok := lookup(src, key); ok {
+			put(key, m[k])
+		}
+	}
+}
+
+// do 一批文档的补充 缓存未命中的key去重后统一查询
+func (lk *esLookup) do(ctx context.Context, cli *elastic.Client, v []*doc) {
+	keys := make(map[*doc]string, len(v))
+	var missing []string
+	seen := make(map[string]bool)
+
+	for _, d := range v {
+		val, ok := d.get(lk.match)
+		if !ok || val == nil {
+			continue
+		}
+
+		key := strutil.String(val)
+		keys[d] = key
+		if _, ok := lk.cache.get(key); ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		missing = append(missing, key)
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	var found map[string]map[string]interface{}
+	if len(missing) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, lk.timeout)
+		r, err := lk.fetch(ctx, cli, missing)
+		cancel()
+
+		if err != nil {
+			atomic.AddUint64(&lk.errors, 1)
+			xEnv.Errorf("lookup index=%s fail %v", lk.index, err)
+		} else {
+			found = r
+			for _, key := range missing {
+				lk.cache.set(key, found[key])
+			}
+		}
+	}
+
+	for d, key := range keys {
+		src, ok := found[key]
+		if !ok {
+			if item, cached := lk.cache.get(key); cached {
+				src, _ = item.(map[string]interface{})
+			}
+		}
+
+		if src == nil {
+			atomic.AddUint64(&lk.miss, 1)
+			continue
+		}
+
+		atomic.AddUint64(&lk.hit, 1)
+		lk.apply(d, src)
+		d.req = nil
+		d.bytes = 0
+	}
+}
+
+type LookupStats struct {
+	Index   string
+	Hit     uint64
+	Miss    uint64
+	Queries uint64
+	Errors  uint64
+}
+
+func (lk *esLookup) Stats() LookupStats {
+	return LookupStats{
+		Index:   lk.index,
+		Hit:     atomic.LoadUint64(&lk.hit),
+		Miss:    atomic.LoadUint64(&lk.miss),
+		Queries: atomic.LoadUint64(&lk.queries),
+		Errors:  atomic.LoadUint64(&lk.errors),
+	}
+}
+
+func (ls LookupStats) table(L *lua.LState) *lua.LTable {
+	tab := L.NewTable()
+	tab.RawSetString("index", lua.S2L(ls.Index))
+	tab.RawSetString("hit", lua.LNumber(ls.Hit))
+	tab.RawSetString("miss", lua.LNumber(ls.Miss))
+	tab.RawSetString("queries", lua.LNumber(ls.Queries))
+	tab.RawSetString("errors", lua.LNumber(ls.Errors))
+	return tab
+}
+
+// lookupStages 启动后声明的lookup会在发送时追加
+func (c *Client) lookupStages() []*esLookup {
+	c.smu.RLock()
+	defer c.smu.RUnlock()
+	return c.lookups
+}
+
+// DoLookup 发送前执行 重试的文档不会重复查询
+func (c *Client) DoLookup(v []*doc, cli *elastic.Client) {
+	lookups := c.lookupStages()
+	if len(lookups) == 0 {
+		return
+	}
+
+	var todo []*doc
+	for _, d := range v {
+		if !d.looked {
+			d.looked = true
+			todo = append(todo, d)
+		}
+	}
+
+	if len(todo) == 0 {
+		return
+	}
+
+	for _, lk := range lookups {
+		lk.do(c.ctx, cli, todo)
+	}
+}
+
+func (c *Client) lookupL(L *lua.LState) int {
+	tab := L.CheckTable(1)
+	lk := &esLookup{key: "_id", timeout: 5 * time.Second}
+	size := 10000
+	ttl := 300
+
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "index":
+			lk.index = val.String()
+		case "match_field":
+			lk.match = val.String()
+		case "key":
+			lk.key = val.String()
+		case "fields":
+			if t, ok := val.(*lua.LTable); ok {
+				lk.fields = auxlib.LTab2SS(t)
+			} else {
+				lk.fields = []string{val.String()}
+			}
+		case "target":
+			lk.target = val.String()
+		case "ttl":
+			ttl = lua.CheckInt(L, val)
+		case "cache":
+			size = lua.CheckInt(L, val)
+		case "timeout":
+			lk.timeout = time.Duration(lua.CheckInt(L, val)) * time.Second
+		}
+	})
+
+	if lk.index == "" || lk.match == "" {
+		L.RaiseError("lookup need index and match_field")
+		return 0
+	}
+
+	lk.cache = newLRU(size, time.Duration(ttl)*time.Second)
+	c.smu.Lock()
+	c.lookups = append(c.lookups[:len(c.lookups):len(c.lookups)], lk)
+	c.smu.Unlock()
+	return 0
+}
@@ -61,6 +61,7 @@ func newLuaIndexL(L *lua.LState) int {
 		fields = append(fields, field)
 	}
 
+	CheckIndex(L, format, fields)
 	L.Push(PrepareIndexL(format, fields))
 	return 1
 
@@ -92,11 +93,28 @@ func newDefaultL(L *lua.LState) int {
 		Thread:   3,
 		Interval: 1,
 		Flush:    10,
+		Retry:    3,
+
+		FlushBytes:   5 << 20,
+		MaxBulkBytes: 50 << 20,
+		Oversize:     OversizeSingle,
+
+		Backoff:    200,
+		BackoffMax: 30000,
+		Jitter:     20,
+
+		QueueSize:       4096,
+		OverflowTimeout: 1000,
+
+		ShutdownTimeout: 10,
+
+		Timestamp: newTimestampConfig(),
 	}
 
 	name := fmt.Sprintf("elastic.%d", atomic.AddUint32(&subscript, 1))
 	v := L.NewVelaData(name, typeof)
 	cli := newClient(cfg)
+	cli.label = name
 	cli.indexL(L)
 
 	v.Set(cli)
@@ -113,7 +131,16 @@ func WithEnv(env vela.Environment) {
 	es.Set("client", lua.NewFunction(newLuaClient))
 	es.Set("index", lua.NewFunction(newLuaIndexL))
 	es.Set("drop", lua.NewFunction(newLuaDropL))
+	es.Set("create", lua.NewFunction(newLuaCreateL))
+	es.Set("update", lua.NewFunction(newLuaUpdateL))
+	es.Set("upsert", lua.NewFunction(newLuaUpsertL))
+	es.Set("delete", lua.NewFunction(newLuaDeleteL))
+	es.Set("script", lua.NewFunction(newLuaScriptL))
+	es.Set("pipeline", lua.NewFunction(newLuaPipelineL))
+	es.Set("routing", lua.NewFunction(newLuaRoutingL))
 	es.Set("default", lua.NewFunction(newDefaultL))
 	es.Set("search", lua.NewFunction(newSearchL))
+	es.Set("metrics", lua.NewFunction(newMetricsL))
+	es.Set("retention", lua.NewFunction(newLuaRetentionL))
 	xEnv.Set("elastic", lua.NewExport("lua.elastic.export", lua.WithFunc(newLuaClient), lua.WithTable(es)))
 }
@@ -0,0 +1,356 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	启动时创建索引模板 组件模板 ILM策略
+	已存在且一致时跳过 不一致时只报告差异 overwrite = true 时覆盖
+
+	cli.ilm{name = "vela-logs" , hot = {max_age = "1d" , max_primary_shard_size = "50gb"} , delete_after = "30d"}
+	cli.component{name = "vela-base" , mappings = {properties = {host = {type = "keyword"}}}}
+	cli.template{
+		name     = "vela-app",
+		patterns = {"vela-app-*"},
+		composed = {"vela-base"},
+		ilm      = "vela-logs",
+		settings = {number_of_shards = 1},
+		mappings = [[{"properties":{"pid":{"type":"long"}}}]],
+	}
+*/
+
+const (
+	kindIndexTemplate     = "index_template"
+	kindComponentTemplate = "component_template"
+	kindILMPolicy         = "ilm_policy"
+)
+
+type managed struct {
+	kind      string
+	name      string
+	body      map[string]interface{}
+	overwrite bool
+}
+
+func (m *managed) path() string {
+	name := url.PathEscape(m.name)
+	switch m.kind {
+	case kindIndexTemplate:
+		return "/_index_template/" + name
+	case kindComponentTemplate:
+		return "/_component_template/" + name
+	default:
+		return "/_ilm/policy/" + name
+	}
+}
+
+// live 从GET结果中取出与声明时结构一致的部分
+func (m *managed) live(body json.RawMessage) (map[string]interface{}, error) {
+	switch m.kind {
+	case kindIndexTemplate:
+		var v struct {
+			IndexTemplates []struct {
+				IndexTemplate map[string]interface{} `json:"index_template"`
+			} `json:"index_templates"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil || len(v.IndexTemplates) == 0 {
+			return nil, err
+		}
+		return v.IndexTemplates[0].IndexTemplate, nil
+
+	case kindComponentTemplate:
+		var v struct {
+			ComponentTemplates []struct {
+				ComponentTemplate map[string]interface{} `json:"component_template"`
+			} `json:"component_templates"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil || len(v.ComponentTemplates) == 0 {
+			return nil, err
+		}
+		return v.ComponentTemplates[0].ComponentTemplate, nil
+
+	default:
+		var v map[string]struct {
+			Policy map[string]interface{} `json:"policy"`
+		}
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, err
+		}
+
+		item, ok := v[m.name]
+		if !ok {
+			return nil, nil
+		}
+		return map[string]interface{}{"policy": item.Policy}, nil
+	}
+}
+
+// flatten 展开成点分隔的路径 settings 中的 index. 前缀统一去掉
+func flatten(prefix string, v interface{}, out map[string]string) {
+	switch item := v.(type) {
+	case map[string]interface{}:
+		for key, val := range item {
+			path := key
+			if prefix != "" {
+				path = prefix + "." + key
+			}
+			flatten(path, val, out)
+		}
+	case []interface{}:
+		for i, val := range item {
+			flatten(prefix+"."+strconv.Itoa(i), val, out)
+		}
+	default:
+		key := strings.Replace(prefix, "settings.index.", "settings.", 1)
+		out[key] = fmt.Sprint(item)
+	}
+}
+
+// drift 返回声明中与线上不一致的路径
+func drift(declared, live map[string]interface{}) []string {
+	want := make(map[string]string)
+	have := make(map[string]string)
+	flatten("", declared, want)
+	flatten("", live, have)
+
+	var diff []string
+	for key, val := range want {
+		if got, ok := have[key]; !ok || got != val {
+			diff = append(diff, fmt.Sprintf("%s want=%s got=%s", key, val, have[key]))
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
+
+func (m *managed) apply(ctx context.Context, cli *elastic.Client) error {
+	rsp, err := cli.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "GET", Path: m.path()})
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+
+	if err == nil {
+		live, e := m.live(rsp.Body)
+		if e != nil {
+			return e
+		}
+
+		if live != nil {
+			diff := drift(m.body, live)
+			if len(diff) == 0 {
+				return nil
+			}
+
+			if !m.overwrite {
+				xEnv.Errorf("elastic %s %s drift: %s", m.kind, m.name, strings.Join(diff, " , "))
+				return nil
+			}
+			xEnv.Errorf("elastic %s %s drift overwrite: %s", m.kind, m.name, strings.Join(diff, " , "))
+		}
+	}
+
+	_, err = cli.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "PUT", Path: m.path(), Body: m.body})
+	return err
+}
+
+// manage 按ilm -> component -> template 的顺序应用 后者可能引用前者
+func (c *Client) manage() {
+	if len(c.managed) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, 30*time.Second)
+	defer cancel()
+
+	cli, err := c.probe(ctx)
+	if err != nil {
+		xEnv.Errorf("%s manage templates client fail %v", c.cfg.name(), err)
+		return
+	}
+	defer cli.Stop()
+
+	order := map[string]int{kindILMPolicy: 0, kindComponentTemplate: 1, kindIndexTemplate: 2}
+	sort.SliceStable(c.managed, func(i, j int) bool {
+		return order[c.managed[i].kind] < order[c.managed[j].kind]
+	})
+
+	for _, m := range c.managed {
+		if e := m.apply(ctx, cli); e != nil {
+			xEnv.Errorf("%s apply %s %s fail %v", c.cfg.name(), m.kind, m.name, e)
+		}
+	}
+}
+
+// luaValue lua值转换成json对象 连续整数下标的table视为数组
+func luaValue(v lua.LValue) interface{} {
+	switch v.Type() {
+	case lua.LTNil:
+		return nil
+	case lua.LTBool:
+		return lua.IsTrue(v)
+	case lua.LTString:
+		return v.String()
+	case lua.LTTable:
+		tab := v.(*lua.LTable)
+		if n := tab.Len(); n > 0 {
+			arr := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				arr = append(arr, luaValue(tab.RawGetInt(i)))
+			}
+			return arr
+		}
+
+		m := make(map[string]interface{})
+		tab.Range(func(key string, val lua.LValue) {
+			m[key] = luaValue(val)
+		})
+		return m
+	}
+
+	if f, ok := v.AssertFloat64(); ok {
+		if f == math.Trunc(f) {
+			return int64(f)
+		}
+		return f
+	}
+	return v.String()
+}
+
+// luaObject 支持lua table 或 json字符串
+func luaObject(L *lua.LState, v lua.LValue) map[string]interface{} {
+	if v.Type() == lua.LTString {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(v.String()), &m); err != nil {
+			L.RaiseError("invalid json object %v", err)
+			return nil
+		}
+		return m
+	}
+
+	m, ok := luaValue(v).(map[string]interface{})
+	if !ok {
+		L.RaiseError("invalid object , got %s", v.Type().String())
+		return nil
+	}
+	return m
+}
+
+func checkName(L *lua.LState, tab *lua.LTable) string {
+	name := tab.RawGetString("name").String()
+	if tab.RawGetString("name").Type() != lua.LTString || name == "" {
+		L.RaiseError("name required")
+	}
+	return name
+}
+
+func (c *Client) templateL(L *lua.LState) int {
+	tab := L.CheckTable(1)
+	m := &managed{kind: kindIndexTemplate, name: checkName(L, tab), body: make(map[string]interface{})}
+
+	tpl := make(map[string]interface{})
+	settings := make(map[string]interface{})
+
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "patterns":
+			m.body["index_patterns"] = luaValue(val)
+		case "composed":
+			m.body["composed_of"] = luaValue(val)
+		case "priority":
+			m.body["priority"] = luaValue(val)
+		case "data_stream":
+			if lua.IsTrue(val) {
+				m.body["data_stream"] = map[string]interface{}{}
+			}
+		case "settings":
+			for k, v := range luaObject(L, val) {
+				settings[k] = v
+			}
+		case "mappings":
+			tpl["mappings"] = luaObject(L, val)
+		case "ilm":
+			settings["index.lifecycle.name"] = val.String()
+		case "overwrite":
+			m.overwrite = lua.IsTrue(val)
+		}
+	})
+
+	if _, ok := m.body["index_patterns"]; !ok {
+		L.RaiseError("template %s patterns required", m.name)
+		return 0
+	}
+
+	if len(settings) > 0 {
+		tpl["settings"] = settings
+	}
+
+	if len(tpl) > 0 {
+		m.body["template"] = tpl
+	}
+
+	c.managed = append(c.managed, m)
+	return 0
+}
+
+func (c *Client) componentL(L *lua.LState) int {
+	tab := L.CheckTable(1)
+	m := &managed{kind: kindComponentTemplate, name: checkName(L, tab)}
+
+	tpl := make(map[string]interface{})
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "settings":
+			tpl["settings"] = luaObject(L, val)
+		case "mappings":
+			tpl["mappings"] = luaObject(L, val)
+		case "overwrite":
+			m.overwrite = lua.IsTrue(val)
+		}
+	})
+
+	m.body = map[string]interface{}{"template": tpl}
+	c.managed = append(c.managed, m)
+	return 0
+}
+
+func (c *Client) ilmL(L *lua.LState) int {
+	tab := L.CheckTable(1)
+	m := &managed{kind: kindILMPolicy, name: checkName(L, tab)}
+
+	phases := make(map[string]interface{})
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "hot":
+			phases["hot"] = map[string]interface{}{
+				"actions": map[string]interface{}{"rollover": luaObject(L, val)},
+			}
+		case "delete_after":
+			phases["delete"] = map[string]interface{}{
+				"min_age": val.String(),
+				"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+			}
+		case "overwrite":
+			m.overwrite = lua.IsTrue(val)
+		}
+	})
+
+	if len(phases) == 0 {
+		L.RaiseError("ilm %s need hot or delete_after", m.name)
+		return 0
+	}
+
+	m.body = map[string]interface{}{"policy": map[string]interface{}{"phases": phases}}
+	c.managed = append(c.managed, m)
+	return 0
+}
@@ -0,0 +1,288 @@
+package elastic
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const metricPrefix = "vela_elastic_"
+
+/*
+	按日期或字段渲染的索引名没有上限
+	最多统计indexStatMax个索引 超出的计入_other
+	超过indexStatIdle没有写入的索引在采集时移除
+*/
+
+const (
+	indexStatMax  = 256
+	indexStatIdle = time.Hour
+	indexOther    = "_other"
+)
+
+// 客户端实例编号 区分索引名相同的客户端
+var instances uint32
+
+// indexStat 按目标索引统计的结果
+type indexStat struct {
+	sent    uint64
+	failed  uint64
+	retried uint64
+	last    int64
+}
+
+func (c *Client) byIndex(index string) *indexStat {
+	v, ok := c.indices.Load(index)
+	if !ok && atomic.LoadInt64(&c.indexN) >= indexStatMax {
+		v, ok = c.indices.Load(indexOther)
+		index = indexOther
+	}
+
+	if !ok {
+		var loaded bool
+		if v, loaded = c.indices.LoadOrStore(index, &indexStat{}); !loaded {
+			atomic.AddInt64(&c.indexN, 1)
+		}
+	}
+
+	is := v.(*indexStat)
+	atomic.StoreInt64(&is.last, time.Now().Unix())
+	return is
+}
+
+// pruneIndices 移除长时间没有写入的索引统计
+func (c *Client) pruneIndices() {
+	deadline := time.Now().Add(-indexStatIdle).Unix()
+	c.indices.Range(func(key, val interface{}) bool {
+		if atomic.LoadInt64(&val.(*indexStat).last) < deadline {
+			c.indices.Delete(key)
+			atomic.AddInt64(&c.indexN, -1)
+		}
+		return true
+	})
+}
+
+// 存活的客户端 启动时注册 关闭时移除
+var live = struct {
+	sync.RWMutex
+	clients map[*Client]struct{}
+}{clients: make(map[*Client]struct{})}
+
+func register(c *Client) {
+	live.Lock()
+	live.clients[c] = struct{}{}
+	live.Unlock()
+}
+
+func unregister(c *Client) {
+	live.Lock()
+	delete(live.clients, c)
+	live.Unlock()
+}
+
+func liveClients() []*Client {
+	live.RLock()
+	v := make([]*Client, 0, len(live.clients))
+	for c := range live.clients {
+		v = append(v, c)
+	}
+	live.RUnlock()
+
+	sort.Slice(v, func(i, j int) bool { return v[i].instance < v[j].instance })
+	return v
+}
+
+type sample struct {
+	name   string
+	help   string
+	kind   prometheus.ValueType
+	keys   []string
+	values []string
+	value  float64
+}
+
+type samples []sample
+
+func (s *samples) add(name, help string, kind prometheus.ValueType, value float64, kv ...string) {
+	smp := sample{name: metricPrefix + name, help: help, kind: kind, value: value}
+	for i := 0; i+1 < len(kv); i += 2 {
+		smp.keys = append(smp.keys, kv[i])
+		smp.values = append(smp.values, kv[i+1])
+	}
+	*s = append(*s, smp)
+}
+
+func (c *Client) samples() samples {
+	var s samples
+	st := c.Stats()
+	name := c.label
+	inst := strconv.FormatUint(uint64(c.instance), 10)
+
+	counter := prometheus.CounterValue
+	gauge := prometheus.GaugeValue
+
+	s.add("received_total", "Documents written to the client.", counter, float64(st.Received), "client", name, "instance", inst)
+	s.add("denoised_total", "Documents suppressed by denoise.", counter, float64(st.Denoised), "client", name, "instance", inst)
+	s.add("dropped_total", "Documents dropped by drop conditions or actions.", counter, float64(st.Dropped), "client", name, "instance", inst)
+	s.add("queued_total", "Documents accepted into the queue.", counter, float64(st.Queued), "client", name, "instance", inst)
+	s.add("spooled_total", "Documents written to the disk spool.", counter, float64(st.Spooled), "client", name, "instance", inst)
+	s.add("replayed_total", "Documents replayed from the disk spool.", counter, float64(st.Replayed), "client", name, "instance", inst)
+	s.add("duplicated_total", "Create operations that found the document already indexed.", counter, float64(st.Duplicated), "client", name, "instance", inst)
+	s.add("queue_depth", "Documents waiting in the queue.", gauge, float64(st.Depth), "client", name, "instance", inst)
+	s.add("queue_capacity", "Queue capacity.", gauge, float64(st.Capacity), "client", name, "instance", inst)
+
+	overflow := map[string]uint64{
+		OverflowBlockTimeout: st.DropTimeout,
+		OverflowDropNewest:   st.DropNewest,
+		OverflowDropOldest:   st.DropOldest,
+		OverflowSpillToDisk:  st.Spilled,
+		"closed":             st.DropClosed,
+	}
+	for _, policy := range []string{OverflowBlockTimeout, OverflowDropNewest, OverflowDropOldest, OverflowSpillToDisk, "closed"} {
+		s.add("overflow_total", "Documents affected by the overflow policy.", counter, float64(overflow[policy]), "client", name, "instance", inst, "policy", policy)
+	}
+
+	c.pruneIndices()
+
+	var indices []string
+	stats := make(map[string]*indexStat)
+	c.indices.Range(func(key, val interface{}) bool {
+		indices = append(indices, key.(string))
+		stats[key.(string)] = val.(*indexStat)
+		return true
+	})
+	sort.Strings(indices)
+
+	for _, index := range indices {
+		is := stats[index]
+		s.add("docs_total", "Bulk item outcomes per target index.", counter, float64(atomic.LoadUint64(&is.sent)), "client", name, "instance", inst, "index", index, "result", "sent")
+		s.add("docs_total", "Bulk item outcomes per target index.", counter, float64(atomic.LoadUint64(&is.failed)), "client", name, "instance", inst, "index", index, "result", "failed")
+		s.add("docs_total", "Bulk item outcomes per target index.", counter, float64(atomic.LoadUint64(&is.retried)), "client", name, "instance", inst, "index", index, "result", "retried")
+	}
+
+	for _, es := range st.Enrich {
+		s.add("enrich_rows", "Rows loaded in the lookup table.", gauge, float64(es.Rows), "client", name, "instance", inst, "file", es.File)
+		s.add("enrich_lookups_total", "Lookup table matches.", counter, float64(es.Hit), "client", name, "instance", inst, "file", es.File, "result", "hit")
+		s.add("enrich_lookups_total", "Lookup table matches.", counter, float64(es.Miss), "client", name, "instance", inst, "file", es.File, "result", "miss")
+	}
+
+	for _, ls := range st.Lookup {
+		s.add("lookup_total", "Index lookup results.", counter, float64(ls.Hit), "client", name, "instance", inst, "index", ls.Index, "result", "hit")
+		s.add("lookup_total", "Index lookup results.", counter, float64(ls.Miss), "client", name, "instance", inst, "index", ls.Index, "result", "miss")
+		s.add("lookup_queries_total", "Batched lookup queries sent.", counter, float64(ls.Queries), "client", name, "instance", inst, "index", ls.Index)
+		s.add("lookup_errors_total", "Failed lookup queries.", counter, float64(ls.Errors), "client", name, "instance", inst, "index", ls.Index)
+	}
+
+	for _, field := range c.conflictFields() {
+		s.add("conflicts_total", "Mapping conflicts per field.", counter, float64(st.Conflicts[field]), "client", name, "instance", inst, "field", field)
+	}
+
+	for _, ts := range st.Threads {
+		id := strconv.Itoa(ts.ID)
+		s.add("thread_accepted_total", "Documents taken from the queue by the thread.", counter, float64(ts.Accepted), "client", name, "instance", inst, "thread", id)
+		s.add("thread_buffered", "Documents buffered in the thread.", gauge, float64(ts.Buffered), "client", name, "instance", inst, "thread", id)
+		s.add("thread_bulks_total", "Bulk requests sent by the thread.", counter, float64(ts.Bulks), "client", name, "instance", inst, "thread", id)
+		s.add("thread_bytes_total", "Encoded bulk bytes sent by the thread.", counter, float64(ts.Bytes), "client", name, "instance", inst, "thread", id)
+		s.add("thread_retries_total", "Bulk retry rounds of the thread.", counter, float64(ts.Retries), "client", name, "instance", inst, "thread", id)
+		s.add("thread_retry_wait_seconds_total", "Time the thread spent waiting to retry.", counter, ts.RetryWait.Seconds(), "client", name, "instance", inst, "thread", id)
+		s.add("thread_bulk_latency_seconds", "Recent bulk latency quantiles.", gauge, ts.Latency.P50.Seconds(), "client", name, "instance", inst, "thread", id, "quantile", "0.5")
+		s.add("thread_bulk_latency_seconds", "Recent bulk latency quantiles.", gauge, ts.Latency.P90.Seconds(), "client", name, "instance", inst, "thread", id, "quantile", "0.9")
+		s.add("thread_bulk_latency_seconds", "Recent bulk latency quantiles.", gauge, ts.Latency.P99.Seconds(), "client", name, "instance", inst, "thread", id, "quantile", "0.99")
+	}
+
+	return s
+}
+
+var labelEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// text 按Prometheus文本格式输出 同名指标合并
+func (s samples) text(buf *bytes.Buffer) {
+	sort.SliceStable(s, func(i, j int) bool { return s[i].name < s[j].name })
+
+	last := ""
+	for _, smp := range s {
+		if smp.name != last {
+			kind := "gauge"
+			if smp.kind == prometheus.CounterValue {
+				kind = "counter"
+			}
+			fmt.Fprintf(buf, "# HELP %s %s\n", smp.name, smp.help)
+			fmt.Fprintf(buf, "# TYPE %s %s\n", smp.name, kind)
+			last = smp.name
+		}
+
+		buf.WriteString(smp.name)
+		if len(smp.keys) > 0 {
+			buf.WriteByte('{')
+			for i, key := range smp.keys {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				fmt.Fprintf(buf, `%s="%s"`, key, labelEscape.Replace(smp.values[i]))
+			}
+			buf.WriteByte('}')
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(smp.value, 'g', -1, 64))
+		buf.WriteByte('\n')
+	}
+}
+
+// Metrics 所有存活客户端的Prometheus文本
+func Metrics() []byte {
+	var all samples
+	for _, c := range liveClients() {
+		all = append(all, c.samples()...)
+	}
+
+	var buf bytes.Buffer
+	all.text(&buf)
+	return buf.Bytes()
+}
+
+// Collector 实现 prometheus.Collector 未指定客户端时采集所有存活的客户端
+type Collector struct {
+	clients []*Client
+}
+
+func NewCollector(clients ...*Client) *Collector {
+	return &Collector{clients: clients}
+}
+
+func (c *Client) Collector() *Collector {
+	return NewCollector(c)
+}
+
+// Describe 标签随索引和线程变化 按unchecked collector处理
+func (col *Collector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (col *Collector) Collect(ch chan<- prometheus.Metric) {
+	clients := col.clients
+	if len(clients) == 0 {
+		clients = liveClients()
+	}
+
+	for _, c := range clients {
+		for _, smp := range c.samples() {
+			desc := prometheus.NewDesc(smp.name, smp.help, smp.keys, nil)
+			m, err := prometheus.NewConstMetric(desc, smp.kind, smp.value, smp.values...)
+			if err != nil {
+				xEnv.Errorf("%s metric %s invalid %v", c.cfg.name(), smp.name, err)
+				continue
+			}
+			ch <- m
+		}
+	}
+}
+
+func newMetricsL(L *lua.LState) int {
+	L.Push(lua.S2L(string(Metrics())))
+	return 1
+}
@@ -0,0 +1,71 @@
+package elastic
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollectorDistinctClients(t *testing.T) {
+	a := newClient(&config{Default: true})
+	b := newClient(&config{Default: true})
+	a.label, b.label = "elastic.1", "elastic.2"
+
+	for _, c := range []*Client{a, b} {
+		c.threads = []*Thread{{ID: 1}}
+		atomic.AddUint64(&c.byIndex("app").sent, 1)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewCollector(a, b))
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("gather two default clients fail %v", err)
+	}
+
+	//标签相同的客户端依靠instance区分
+	b.label = a.label
+	if _, err := reg.Gather(); err != nil {
+		t.Fatalf("gather clients with the same label fail %v", err)
+	}
+}
+
+func TestIndexStatBounded(t *testing.T) {
+	c := newClient(&config{})
+
+	for i := 0; i < indexStatMax+50; i++ {
+		atomic.AddUint64(&c.byIndex(fmt.Sprintf("app-%d", i)).sent, 1)
+	}
+
+	if n := atomic.LoadInt64(&c.indexN); n > indexStatMax+1 {
+		t.Fatalf("tracked %d indices want at most %d", n, indexStatMax+1)
+	}
+
+	v, ok := c.indices.Load(indexOther)
+	if !ok || atomic.LoadUint64(&v.(*indexStat).sent) != 50 {
+		t.Fatalf("overflow indices not counted in %s", indexOther)
+	}
+
+	//长时间没有写入的索引在采集时移除
+	c.indices.Range(func(_, val interface{}) bool {
+		atomic.StoreInt64(&val.(*indexStat).last, time.Now().Add(-2*indexStatIdle).Unix())
+		return true
+	})
+	atomic.AddUint64(&c.byIndex("app-1").sent, 1)
+
+	c.pruneIndices()
+	if n := atomic.LoadInt64(&c.indexN); n != 1 {
+		t.Errorf("tracked %d indices after prune want 1", n)
+	}
+
+	if _, ok := c.indices.Load("app-1"); !ok {
+		t.Errorf("prune removed an active index")
+	}
+
+	//移除后空出的位置可以统计新的索引
+	atomic.AddUint64(&c.byIndex("app-new").sent, 1)
+	if _, ok := c.indices.Load("app-new"); !ok {
+		t.Errorf("new index not tracked after prune")
+	}
+}
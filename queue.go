@@ -0,0 +1,144 @@
+package elastic
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+	overflow 队列满时的处理方式
+	block         阻塞直到有空位(默认)
+	block_timeout 阻塞overflow_timeout毫秒 超时丢弃
+	drop_newest   丢弃当前写入的文档
+	drop_oldest   丢弃队列中最老的文档 写入当前文档
+	spill_to_disk 写入磁盘缓存 需要配置spool
+*/
+
+const (
+	OverflowBlock        = "block"
+	OverflowBlockTimeout = "block_timeout"
+	OverflowDropNewest   = "drop_newest"
+	OverflowDropOldest   = "drop_oldest"
+	OverflowSpillToDisk  = "spill_to_disk"
+)
+
+func validOverflow(v string) bool {
+	switch v {
+	case OverflowBlock, OverflowBlockTimeout, OverflowDropNewest, OverflowDropOldest, OverflowSpillToDisk:
+		return true
+	}
+	return false
+}
+
+func (c *Client) overflow() string {
+	if c.cfg.Overflow != "" {
+		return c.cfg.Overflow
+	}
+
+	if c.spool != nil {
+		return OverflowSpillToDisk
+	}
+	return OverflowBlock
+}
+
+// enqueue 队列满需要落盘时在释放读锁之后spill
+// spill失败会走 reject -> bury -> offer 再次获取读锁 Shutdown等待写锁时会死锁
+func (c *Client) enqueue(d *doc) {
+	if c.admit(d) {
+		atomic.AddUint64(&c.spilled, 1)
+		c.spill(d)
+	}
+}
+
+// admit 按overflow策略写入队列 返回true表示需要写入磁盘缓存
+func (c *Client) admit(d *doc) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		atomic.AddUint64(&c.dropClosed, 1)
+		return false
+	}
+
+	switch c.overflow() {
+	case OverflowBlockTimeout:
+		tm := time.NewTimer(time.Duration(c.cfg.OverflowTimeout) * time.Millisecond)
+		defer tm.Stop()
+
+		select {
+		case c.queue <- d:
+			atomic.AddUint64(&c.queued, 1)
+		case <-c.stop:
+			atomic.AddUint64(&c.dropClosed, 1)
+		case <-tm.C:
+			atomic.AddUint64(&c.dropTimeout, 1)
+		}
+
+	case OverflowDropNewest:
+		select {
+		case c.queue <- d:
+			atomic.AddUint64(&c.queued, 1)
+		default:
+			atomic.AddUint64(&c.dropNewest, 1)
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case c.queue <- d:
+				atomic.AddUint64(&c.queued, 1)
+				return false
+			default:
+			}
+
+			select {
+			case <-c.queue:
+				atomic.AddUint64(&c.dropOldest, 1)
+			default:
+			}
+		}
+
+	case OverflowSpillToDisk:
+		select {
+		case c.queue <- d:
+			atomic.AddUint64(&c.queued, 1)
+		default:
+			return true
+		}
+
+	default:
+		select {
+		case c.queue <- d:
+			atomic.AddUint64(&c.queued, 1)
+		case <-c.stop:
+			atomic.AddUint64(&c.dropClosed, 1)
+		}
+	}
+
+	return false
+}
+
+// offer 非阻塞写入队列 关闭后或队列满时返回false
+func (c *Client) offer(d *doc) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return false
+	}
+
+	select {
+	case c.queue <- d:
+		return true
+	default:
+		return false
+	}
+}
+
+// Overflow 返回各策略的丢弃计数
+func (c *Client) Overflow() (timeout, newest, oldest, spilled uint64) {
+	return atomic.LoadUint64(&c.dropTimeout),
+		atomic.LoadUint64(&c.dropNewest),
+		atomic.LoadUint64(&c.dropOldest),
+		atomic.LoadUint64(&c.spilled)
+}
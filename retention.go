@@ -0,0 +1,530 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var retentionTypeof = reflect.TypeOf((*retention)(nil)).String()
+
+/*
+	按索引名称中的日期清理过期索引 适用于没有ILM的集群
+
+	local r = vela.elastic.retention{
+		url      = "http://127.0.0.1:9200",  --连接参数同 vela.elastic.cli 不配置url时走默认通道
+		pattern  = "vela-es-*",
+		layout   = "2006-01-02",             --索引名称中的日期格式 默认2006-01-02
+		keep     = "30d",
+		action   = "delete",                 --delete close freeze
+		interval = 3600,
+		dry_run  = false,                    --默认true 只记录日志 确认后显式关闭
+	}
+	r.start()
+
+	cli.retention{keep = "30d" , action = "close" , dry_run = false}
+	按客户端的索引模板推导pattern和layout
+	日期只按模板中的位置匹配 推导出的pattern以通配符开头时拒绝运行 需要显式配置pattern
+*/
+
+const (
+	RetentionDelete = "delete"
+	RetentionClose  = "close"
+	RetentionFreeze = "freeze"
+)
+
+type retention struct {
+	lua.SuperVelaData
+	name     string
+	pattern  string
+	layout   string
+	custom   bool
+	match    *regexp.Regexp
+	keep     time.Duration
+	action   string
+	interval time.Duration
+	dryRun   bool
+	client   func(context.Context) (*elastic.Client, error)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// parseKeep 支持 30d 12h 2w 以及time.ParseDuration的格式
+func parseKeep(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	if n := len(v); n > 1 {
+		unit := time.Duration(0)
+		switch v[n-1] {
+		case 'd':
+			unit = 24 * time.Hour
+		case 'w':
+			unit = 7 * 24 * time.Hour
+		}
+
+		if unit > 0 {
+			num, err := strconv.Atoi(v[:n-1])
+			if err != nil {
+				return 0, fmt.Errorf("invalid keep %s", v)
+			}
+			return time.Duration(num) * unit, nil
+		}
+	}
+
+	return time.ParseDuration(v)
+}
+
+func newRetention(L *lua.LState, tab *lua.LTable) *retention {
+	r := &retention{
+		layout:   "2006-01-02",
+		action:   RetentionDelete,
+		interval: time.Hour,
+		dryRun:   true,
+	}
+
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "name":
+			r.name = val.String()
+		case "pattern":
+			r.pattern = val.String()
+		case "layout":
+			r.layout = val.String()
+			r.custom = true
+		case "keep":
+			d, err := parseKeep(val.String())
+			if err != nil {
+				L.RaiseError("%v", err)
+				return
+			}
+			r.keep = d
+		case "action":
+			switch a := val.String(); a {
+			case RetentionDelete, RetentionClose, RetentionFreeze:
+				r.action = a
+			default:
+				L.RaiseError("invalid retention action , got %s", a)
+			}
+		case "interval":
+			r.interval = time.Duration(lua.CheckInt(L, val)) * time.Second
+		case "dry_run":
+			r.dryRun = lua.IsTrue(val)
+		}
+	})
+
+	if r.keep <= 0 {
+		L.RaiseError("retention keep required")
+	}
+
+	return r
+}
+
+func (r *retention) Name() string {
+	if r.name != "" {
+		return r.name
+	}
+	return "vela.elastic.retention." + r.pattern
+}
+
+func (r *retention) Type() string {
+	return retentionTypeof
+}
+
+// indexDate 按模板推导时只取模板中日期位置的值
+// 显式配置pattern时在名称中查找符合layout的日期 取最后一个 前后必须是分隔符 避免匹配到其他数字的一部分
+func (r *retention) indexDate(name string) (time.Time, bool) {
+	if r.match != nil {
+		m := r.match.FindStringSubmatch(name)
+		if len(m) != 2 {
+			return time.Time{}, false
+		}
+
+		t, err := time.Parse(r.layout, m[1])
+		return t, err == nil
+	}
+
+	n := len(r.layout)
+	for i := len(name) - n; i >= 0; i-- {
+		if !separated(name, i-1) || !separated(name, i+n) {
+			continue
+		}
+
+		t, err := time.Parse(r.layout, name[i:i+n])
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func separated(name string, i int) bool {
+	if i < 0 || i >= len(name) {
+		return true
+	}
+
+	ch := name[i]
+	return !(ch >= '0' && ch <= '9') && !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z')
+}
+
+type catIndex struct {
+	Index  string `json:"index"`
+	Status string `json:"status"`
+}
+
+func (r *retention) indices(ctx context.Context, cli *elastic.Client) ([]catIndex, error) {
+	params := url.Values{}
+	params.Set("format", "json")
+	params.Set("h", "index,status")
+	params.Set("expand_wildcards", "open,closed")
+
+	rsp, err := cli.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/_cat/indices/" + url.PathEscape(r.pattern),
+		Params: params,
+	})
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var rows []catIndex
+	err = json.Unmarshal(rsp.Body, &rows)
+	return rows, err
+}
+
+func (r *retention) do(ctx context.Context, cli *elastic.Client, name string) error {
+	switch r.action {
+	case RetentionClose:
+		_, err := cli.CloseIndex(name).Do(ctx)
+		return err
+	case RetentionFreeze:
+		_, err := cli.PerformRequest(ctx, elastic.PerformRequestOptions{Method: "POST", Path: "/" + url.PathEscape(name) + "/_freeze"})
+		return err
+	default:
+		_, err := cli.DeleteIndex(name).Do(ctx)
+		return err
+	}
+}
+
+// Run 执行一次清理
+func (r *retention) Run(ctx context.Context) error {
+	cli, err := r.client(ctx)
+	if err != nil {
+		return err
+	}
+	defer cli.Stop()
+
+	rows, err := r.indices(ctx, cli)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(-r.keep)
+	for _, row := range rows {
+		if row.Status == "close" && r.action != RetentionDelete {
+			continue
+		}
+
+		t, ok := r.indexDate(row.Index)
+		if !ok || !t.Before(deadline) {
+			continue
+		}
+
+		if r.dryRun {
+			xEnv.Infof("%s dry_run %s index=%s date=%s keep=%s", r.Name(), r.action, row.Index, t.Format(r.layout), r.keep)
+			continue
+		}
+
+		if e := r.do(ctx, cli, row.Index); e != nil {
+			xEnv.Errorf("%s %s index=%s fail %v", r.Name(), r.action, row.Index, e)
+			continue
+		}
+		xEnv.Infof("%s %s index=%s date=%s keep=%s", r.Name(), r.action, row.Index, t.Format(r.layout), r.keep)
+	}
+
+	return nil
+}
+
+func (r *retention) loop() {
+	defer r.wg.Done()
+
+	tk := time.NewTicker(r.interval)
+	defer tk.Stop()
+
+	for {
+		if err := r.Run(r.ctx); err != nil {
+			xEnv.Errorf("%s run fail %v", r.Name(), err)
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-tk.C:
+		}
+	}
+}
+
+func (r *retention) Start() error {
+	if r.pattern == "" {
+		return fmt.Errorf("retention pattern required")
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.wg.Add(1)
+	go r.loop()
+	return nil
+}
+
+func (r *retention) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+		r.wg.Wait()
+	}
+	return nil
+}
+
+func (r *retention) startL(L *lua.LState) int {
+	xEnv.Start(L, r).From(L.CodeVM()).Do()
+	return 0
+}
+
+func (r *retention) runL(L *lua.LState) int {
+	if err := r.Run(L.Context()); err != nil {
+		L.RaiseError("%s run fail %v", r.Name(), err)
+	}
+	return 0
+}
+
+func (r *retention) Index(L *lua.LState, key string) lua.LValue {
+	switch key {
+	case "start":
+		return lua.NewFunction(r.startL)
+	case "run":
+		return lua.NewFunction(r.runL)
+	}
+	return lua.LNil
+}
+
+var (
+	fmtVerb    = regexp.MustCompile(`%[-+# 0-9.]*[a-zA-Z]`)
+	dateLayout = map[string]string{
+		"$year":  "2006",
+		"$month": "2006-01",
+		"$day":   "2006-01-02",
+		"$hour":  "2006-01-02-15",
+	}
+)
+
+const (
+	shapeLiteral uint8 = iota
+	shapeWild
+	shapeDate
+)
+
+type shapePart struct {
+	kind uint8
+	text string
+}
+
+// indexShape 索引模板拆成字面量 通配和日期三种片段
+type indexShape struct {
+	parts  []shapePart
+	layout string
+}
+
+func (s *indexShape) add(kind uint8, text string) {
+	if kind == shapeDate {
+		//多个日期时只按最后一个判断
+		for i := range s.parts {
+			if s.parts[i].kind == shapeDate {
+				s.parts[i].kind = shapeWild
+			}
+		}
+	}
+	s.parts = append(s.parts, shapePart{kind: kind, text: text})
+}
+
+func (s *indexShape) pattern() string {
+	var buf strings.Builder
+	for _, p := range s.parts {
+		if p.kind == shapeLiteral {
+			buf.WriteString(p.text)
+			continue
+		}
+		buf.WriteByte('*')
+	}
+	return buf.String()
+}
+
+// anchor 日期固定在模板中的位置 layout需要是定长格式 模板中没有日期时返回nil
+func (s *indexShape) anchor(layout string) *regexp.Regexp {
+	var buf strings.Builder
+	dated := false
+
+	buf.WriteByte('^')
+	for _, p := range s.parts {
+		switch p.kind {
+		case shapeLiteral:
+			buf.WriteString(regexp.QuoteMeta(p.text))
+		case shapeWild:
+			buf.WriteString(".*")
+		case shapeDate:
+			buf.WriteString("(.{" + strconv.Itoa(len(layout)) + "})")
+			dated = true
+		}
+	}
+	buf.WriteByte('$')
+
+	if !dated {
+		return nil
+	}
+	return regexp.MustCompile(buf.String())
+}
+
+// derive 根据客户端索引模板推导通配符和日期格式
+func derive(format string, fields []string) *indexShape {
+	s := &indexShape{}
+
+	if len(fields) == 0 && strings.Contains(format, "${") {
+		tpl, err := parseIndexTemplate(format)
+		if err != nil {
+			return s
+		}
+
+		for _, p := range tpl.parts {
+			if p.field == "" {
+				s.add(shapeLiteral, p.literal)
+				continue
+			}
+
+			kind := shapeWild
+			for _, f := range p.filters {
+				if f.name == "date" {
+					kind = shapeDate
+					s.layout = strings.Join(f.args, ":")
+				}
+			}
+			s.add(kind, "")
+		}
+		return s
+	}
+
+	rest := format
+	for i, loc := range fmtVerb.FindAllStringIndex(format, -1) {
+		off := len(format) - len(rest)
+		s.add(shapeLiteral, strings.ReplaceAll(rest[:loc[0]-off], "%%", "%"))
+		rest = rest[loc[1]-off:]
+
+		if i >= len(fields) {
+			s.add(shapeWild, "")
+			continue
+		}
+
+		field := fields[i]
+		switch {
+		case field[0] != '$':
+			s.add(shapeLiteral, field)
+		case dateLayout[field] != "":
+			s.layout = dateLayout[field]
+			s.add(shapeDate, "")
+		case strings.HasPrefix(field, "$time{") && strings.HasSuffix(field, "}"):
+			s.layout = field[6 : len(field)-1]
+			s.add(shapeDate, "")
+		default:
+			s.add(shapeWild, "")
+		}
+	}
+	s.add(shapeLiteral, strings.ReplaceAll(rest, "%%", "%"))
+
+	return s
+}
+
+func newLuaRetentionL(L *lua.LState) int {
+	cfg := newConfig(L)
+	r := newRetention(L, L.CheckTable(1))
+	r.client = func(ctx context.Context) (*elastic.Client, error) {
+		if cfg.Default || len(cfg.URLs) == 0 {
+			return EsApiClient()
+		}
+
+		opt, err := cfg.OptionsFunc()
+		if err != nil {
+			return nil, err
+		}
+		return elastic.DialContext(ctx, opt...)
+	}
+
+	proc := L.NewVelaData(r.Name(), retentionTypeof)
+	proc.Set(r)
+	L.Push(proc)
+	return 1
+}
+
+// startRetention 索引模板可能在retention之后设置 所以启动时才推导
+func (c *Client) startRetention() {
+	r := c.retain
+	if r == nil {
+		return
+	}
+
+	format := c.format
+	if format == "" {
+		format = c.cfg.Index
+	}
+
+	if r.name == "" {
+		r.name = c.cfg.name() + ".retention"
+	}
+
+	shape := derive(format, c.fields)
+	if shape.layout != "" && !r.custom {
+		r.layout = shape.layout
+	}
+
+	//显式配置的pattern按分隔符查找日期 推导的pattern必须有固定前缀和日期位置 避免处理不是这个客户端写入的索引
+	if r.pattern == "" {
+		pattern := shape.pattern()
+		if pattern == "" || strings.HasPrefix(pattern, "*") {
+			xEnv.Errorf("%s derived pattern %q starts with wildcard , set pattern explicitly", r.Name(), pattern)
+			return
+		}
+
+		r.match = shape.anchor(r.layout)
+		if r.match == nil {
+			xEnv.Errorf("%s index %s has no date , set pattern explicitly", r.Name(), format)
+			return
+		}
+		r.pattern = pattern
+	}
+
+	if err := r.Start(); err != nil {
+		xEnv.Errorf("%s start fail %v", r.Name(), err)
+	}
+}
+
+func (c *Client) retentionL(L *lua.LState) int {
+	r := newRetention(L, L.CheckTable(1))
+	r.client = c.probe
+	if c.retain != nil {
+		c.retain.Close()
+	}
+	c.retain = r
+
+	//vela.elastic.default() 声明前已经启动
+	if c.started() {
+		c.startRetention()
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+package elastic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseKeep(t *testing.T) {
+	cases := []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "30d", want: 30 * 24 * time.Hour},
+		{in: "2w", want: 14 * 24 * time.Hour},
+		{in: "12h", want: 12 * time.Hour},
+		{in: " 90m ", want: 90 * time.Minute},
+		{in: "xd", err: true},
+		{in: "abc", err: true},
+	}
+
+	for _, c := range cases {
+		got, err := parseKeep(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseKeep(%q) want error , got %s", c.in, got)
+			}
+			continue
+		}
+
+		if err != nil || got != c.want {
+			t.Errorf("parseKeep(%q) = %s , %v want %s", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestDerive(t *testing.T) {
+	cases := []struct {
+		format  string
+		fields  []string
+		pattern string
+		layout  string
+		dated   bool
+	}{
+		{format: "vela-es-%s", fields: []string{"$day"}, pattern: "vela-es-*", layout: "2006-01-02", dated: true},
+		{format: "%s-app-%s", fields: []string{"$day", "app"}, pattern: "*-app-app", layout: "2006-01-02", dated: true},
+		{format: "app-%s-%s", fields: []string{"$host", "$month"}, pattern: "app-*-*", layout: "2006-01", dated: true},
+		{format: "app-%s", fields: []string{"$time{2006.01.02}"}, pattern: "app-*", layout: "2006.01.02", dated: true},
+		{format: "app-%s", fields: []string{"$host"}, pattern: "app-*"},
+		{format: "app-${service|lower}-${@timestamp|date:2006.01}", pattern: "app-*-*", layout: "2006.01", dated: true},
+		{format: "${@timestamp|date:2006.01.02}-app", pattern: "*-app", layout: "2006.01.02", dated: true},
+		{format: "app-static", pattern: "app-static"},
+	}
+
+	for _, c := range cases {
+		s := derive(c.format, c.fields)
+		if got := s.pattern(); got != c.pattern {
+			t.Errorf("derive(%q) pattern = %q want %q", c.format, got, c.pattern)
+		}
+
+		if s.layout != c.layout {
+			t.Errorf("derive(%q) layout = %q want %q", c.format, s.layout, c.layout)
+		}
+
+		if dated := s.anchor(s.layout) != nil; dated != c.dated {
+			t.Errorf("derive(%q) anchored = %v want %v", c.format, dated, c.dated)
+		}
+	}
+}
+
+func TestIndexDateAnchored(t *testing.T) {
+	day := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		format string
+		fields []string
+		index  string
+		want   time.Time
+		ok     bool
+	}{
+		{format: "vela-es-%s", fields: []string{"$day"}, index: "vela-es-2024-01-02", want: day, ok: true},
+		{format: "vela-es-%s", fields: []string{"$day"}, index: "vela-es-2024-01-02-restored"},
+		{format: "vela-es-%s", fields: []string{"$day"}, index: "vela-es-2024-13-02"},
+		{format: "vela-es-%s", fields: []string{"$day"}, index: "other-2024-01-02"},
+		{format: "app-%s-%s", fields: []string{"$host", "$day"}, index: "app-web-01-2024-01-02", want: day, ok: true},
+		{format: "%s-app-%s", fields: []string{"$day", "app"}, index: "2024-01-02-app-app", want: day, ok: true},
+		{format: "app-${host}-${@timestamp|date:2006.01.02}", index: "app-db-2024.01.02", want: day, ok: true},
+		{format: "app-${host}-${@timestamp|date:2006.01.02}", index: "app-2024.01.02-db"},
+	}
+
+	for _, c := range cases {
+		s := derive(c.format, c.fields)
+		r := &retention{layout: s.layout, match: s.anchor(s.layout)}
+
+		got, ok := r.indexDate(c.index)
+		if ok != c.ok || (ok && !got.Equal(c.want)) {
+			t.Errorf("%q indexDate(%q) = %s , %v want %s , %v", c.format, c.index, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestIndexDateExplicit(t *testing.T) {
+	cases := []struct {
+		layout string
+		index  string
+		want   time.Time
+		ok     bool
+	}{
+		{layout: "2006-01-02", index: "vela-es-2024-01-02", want: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), ok: true},
+		{layout: "2006.01", index: "logs-2019.10", want: time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC), ok: true},
+		{layout: "2006", index: "logs-2019.10", want: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), ok: true},
+		{layout: "2006", index: "app12345-x"},
+		{layout: "2006", index: "app-20231"},
+		{layout: "2006-01-02", index: "vela-es-latest"},
+	}
+
+	for _, c := range cases {
+		r := &retention{layout: c.layout}
+
+		got, ok := r.indexDate(c.index)
+		if ok != c.ok || (ok && !got.Equal(c.want)) {
+			t.Errorf("%q indexDate(%q) = %s , %v want %s , %v", c.layout, c.index, got, ok, c.want, c.ok)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package elastic
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// retryAfter 记录最近一次响应中的Retry-After
+type retryAfter struct {
+	rt  http.RoundTripper
+	val int64
+}
+
+func newRetryAfter(rt http.RoundTripper) *retryAfter {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &retryAfter{rt: rt}
+}
+
+func (ra *retryAfter) RoundTrip(r *http.Request) (*http.Response, error) {
+	rsp, err := ra.rt.RoundTrip(r)
+	if err != nil || rsp == nil {
+		return rsp, err
+	}
+
+	if d, ok := parseRetryAfter(rsp.Header.Get("Retry-After")); ok {
+		atomic.StoreInt64(&ra.val, int64(d))
+	}
+	return rsp, nil
+}
+
+// take 取出并清空
+func (ra *retryAfter) take() time.Duration {
+	return time.Duration(atomic.SwapInt64(&ra.val, 0))
+}
+
+// parseRetryAfter 支持秒数和HTTP时间两种格式
+func parseRetryAfter(v string) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+
+	if sec, err := strconv.Atoi(v); err == nil {
+		if sec < 0 {
+			return 0, false
+		}
+		return time.Duration(sec) * time.Second, true
+	}
+
+	at, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	d := time.Until(at)
+	if d < 0 {
+		return 0, true
+	}
+	return d, true
+}
+
+// backoff 指数退避 initial * 2^attempt 不超过max 再加上jitter百分比的随机抖动
+func (cfg *config) backoff(attempt int) time.Duration {
+	initial := time.Duration(cfg.Backoff) * time.Millisecond
+	limit := time.Duration(cfg.BackoffMax) * time.Millisecond
+
+	d := initial
+	for i := 0; i < attempt && d < limit; i++ {
+		d = d * 2
+	}
+
+	if d > limit {
+		d = limit
+	}
+
+	if cfg.Jitter <= 0 || d <= 0 {
+		return d
+	}
+
+	delta := float64(d) * float64(cfg.Jitter) / 100
+	return d + time.Duration(delta*(2*rand.Float64()-1))
+}
+
+func throttled(v []*doc) bool {
+	for _, d := range v {
+		if d.status == http.StatusTooManyRequests {
+			return true
+		}
+	}
+	return false
+}
+
+// wait 计算下一次重试前的等待时间
+func (th *Thread) wait(attempt int, retry []*doc) time.Duration {
+	d := th.cfg.backoff(attempt)
+
+	//429 集群明确要求降速 等待时间翻倍
+	if throttled(retry) {
+		d = d * 2
+		if limit := time.Duration(th.cfg.BackoffMax) * time.Millisecond; d > limit {
+			d = limit
+		}
+	}
+
+	if th.after == nil {
+		return d
+	}
+
+	if ra := th.after.take(); ra > d {
+		return ra
+	}
+	return d
+}
+
+// sleep 等待期间响应ctx退出 返回false表示已退出
+func (th *Thread) sleep(d time.Duration) bool {
+	tm := time.NewTimer(d)
+	defer tm.Stop()
+
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&th.waited, int64(time.Since(start)))
+	}()
+
+	select {
+	case <-th.ctx.Done():
+		return false
+	case <-tm.C:
+		return true
+	}
+}
+
+// RetryStats 返回所有线程的重试次数和重试等待总时长
+func (c *Client) RetryStats() (attempts uint64, waited time.Duration) {
+	for _, th := range c.threads {
+		attempts += atomic.LoadUint64(&th.retries)
+		waited += time.Duration(atomic.LoadInt64(&th.waited))
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package elastic
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ShutdownReport 关闭时的处理结果
+type ShutdownReport struct {
+	Flushed uint64
+	Spooled uint64
+	Lost    uint64
+	Timeout bool
+	Elapsed time.Duration
+}
+
+/*
+	Shutdown 有序关闭
+	1. 停止接收新的写入 取消正在进行的回放
+	2. 关闭队列 线程读完队列并发送各自的缓冲
+	3. 超过shutdown_timeout后取消所有请求
+	4. 剩余未发送的文档按shutdown_spool写入磁盘缓存 否则计为丢失
+	Spooled 包含第2步中超过重试次数落盘的文档 Lost 只统计第4步没有落盘的文档
+*/
+
+func (c *Client) Shutdown() *ShutdownReport {
+	c.once.Do(func() {
+		c.report = c.shutdown()
+	})
+	return c.report
+}
+
+func (c *Client) shutdown() *ShutdownReport {
+	r := &ShutdownReport{}
+	start := time.Now()
+	succeed := atomic.LoadUint64(&c.succeed)
+	spooled := atomic.LoadUint64(&c.spooled)
+
+	unregister(c)
+	if c.retain != nil {
+		c.retain.Close()
+	}
+	close(c.stop)
+	//回放中的探测和请求不受shutdown_timeout限制 先取消再等待
+	if c.halt != nil {
+		c.halt()
+	}
+	c.wg.Wait()
+
+	c.mu.Lock()
+	c.closed = true
+	close(c.queue)
+	c.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.workers.Wait()
+		close(done)
+	}()
+
+	tm := time.NewTimer(time.Duration(c.cfg.ShutdownTimeout) * time.Second)
+	select {
+	case <-done:
+	case <-tm.C:
+		r.Timeout = true
+		c.cancel()
+		<-done
+	}
+	tm.Stop()
+	c.cancel()
+
+	//线程发送时超过重试次数落盘的文档
+	drained := atomic.LoadUint64(&c.spooled) - spooled
+
+	var left []*doc
+	for _, th := range c.threads {
+		left = append(left, th.bucket...)
+		th.bucket = nil
+	}
+
+	for d := range c.queue {
+		left = append(left, d)
+	}
+
+	//只统计剩余文档的落盘结果 spool_error时spill不计数 全部计为丢失
+	if n := len(left); n > 0 {
+		if c.cfg.ShutdownSpool && c.spool != nil {
+			before := atomic.LoadUint64(&c.spooled)
+			c.spill(left...)
+			r.Spooled = atomic.LoadUint64(&c.spooled) - before
+		}
+		r.Lost = uint64(n) - r.Spooled
+	}
+	r.Spooled += drained
+
+	if c.spool != nil {
+		c.spool.close()
+	}
+
+	if c.dead != nil {
+		c.dead.close()
+	}
+
+	if geo := c.geoStage(); geo != nil {
+		geo.close()
+	}
+
+	r.Flushed = atomic.LoadUint64(&c.succeed) - succeed
+	r.Elapsed = time.Since(start)
+	return r
+}
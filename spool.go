@@ -0,0 +1,464 @@
+package elastic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/olivere/elastic/v7"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spoolExt      = ".spool"
+	spoolInterval = 5 * time.Second
+)
+
+// record 落盘的文档格式 每行一个json
+type record struct {
+	Index    string                 `json:"index"`
+	ID       string                 `json:"id,omitempty"`
+	Op       string                 `json:"op,omitempty"`
+	Script   string                 `json:"script,omitempty"`
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Pipeline string                 `json:"pipeline,omitempty"`
+	Routing  string                 `json:"routing,omitempty"`
+	Dead     bool                   `json:"dead,omitempty"`
+	Data     map[string]interface{} `json:"data"`
+}
+
+func (d *doc) record() record {
+	return record{
+		Index:    d.index,
+		ID:       d.id,
+		Op:       d.op,
+		Script:   d.script,
+		Params:   d.params,
+		Pipeline: d.pipeline,
+		Routing:  d.routing,
+		Dead:     d.dead,
+		Data:     d.data,
+	}
+}
+
+func (r record) doc() *doc {
+	return &doc{
+		action:   ACCEPT,
+		index:    r.Index,
+		id:       r.ID,
+		op:       r.Op,
+		script:   r.Script,
+		params:   r.Params,
+		pipeline: r.Pipeline,
+		routing:  r.Routing,
+		dead:     r.Dead,
+		data:     r.Data,
+	}
+}
+
+/*
+	spool 磁盘缓存队列
+	dir/00000000000000000001.spool
+	dir/00000000000000000002.spool
+	写入时追加到当前分段 超过分段大小后切换新分段
+	回放时按分段顺序读取 读取完成后删除 当前分段只在回放时封存
+*/
+
+type spool struct {
+	mu      sync.Mutex
+	dir     string
+	segment int64
+	maxSize int64
+	maxAge  time.Duration
+	seq     uint64
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+}
+
+func newSpool(cfg *config) (*spool, error) {
+	if err := os.MkdirAll(cfg.Spool, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:     cfg.Spool,
+		segment: int64(cfg.SpoolSegment) << 20,
+		maxSize: int64(cfg.SpoolMaxSize) << 20,
+		maxAge:  time.Duration(cfg.SpoolMaxAge) * time.Second,
+	}
+
+	//重启后接着已有的分段编号继续
+	seg, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	if n := len(seg); n > 0 {
+		s.seq = segmentSeq(seg[n-1])
+	}
+
+	return s, nil
+}
+
+func segmentSeq(path string) uint64 {
+	name := strings.TrimSuffix(filepath.Base(path), spoolExt)
+	seq, _ := strconv.ParseUint(name, 10, 64)
+	return seq
+}
+
+func (s *spool) path(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolExt))
+}
+
+// segments 返回按顺序排列的分段文件
+func (s *spool) segments() ([]string, error) {
+	seg, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(seg)
+	return seg, nil
+}
+
+func (s *spool) open() error {
+	s.seq++
+	fd, err := os.OpenFile(s.path(s.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.file = fd
+	s.writer = bufio.NewWriter(fd)
+	s.size = 0
+	return nil
+}
+
+// seal 关闭当前分段 之后的写入进入新分段
+func (s *spool) seal() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.writer.Flush()
+	if e := s.file.Close(); err == nil {
+		err = e
+	}
+
+	s.file = nil
+	s.writer = nil
+	return err
+}
+
+func (s *spool) push(v ...*doc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range v {
+		chunk, err := json.Marshal(d.record())
+		if err != nil {
+			return err
+		}
+
+		if s.file == nil || (s.segment > 0 && s.size >= s.segment) {
+			if err = s.seal(); err != nil {
+				return err
+			}
+
+			if err = s.open(); err != nil {
+				return err
+			}
+		}
+
+		n, err := s.writer.Write(append(chunk, '\n'))
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.writer.Flush()
+}
+
+// sealed 封存当前分段并返回所有可回放的分段
+func (s *spool) sealed() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.seal(); err != nil {
+		return nil, err
+	}
+
+	return s.segments()
+}
+
+// frozen 返回已经封存的分段 不包含正在写入的分段
+func (s *spool) frozen() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seg, err := s.segments()
+	if err != nil || s.file == nil {
+		return seg, err
+	}
+
+	active := s.path(s.seq)
+	v := seg[:0]
+	for _, path := range seg {
+		if path != active {
+			v = append(v, path)
+		}
+	}
+	return v, nil
+}
+
+// pending 是否有等待回放的文档
+func (s *spool) pending() bool {
+	seg, err := s.frozen()
+	if err == nil && len(seg) > 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file != nil && s.size > 0
+}
+
+// trim 按最大容量和最大保存时间清理最老的分段
+func (s *spool) trim() {
+	seg, err := s.frozen()
+	if err != nil {
+		xEnv.Errorf("elastic spool %s trim fail %v", s.dir, err)
+		return
+	}
+
+	var total int64
+	info := make([]os.FileInfo, len(seg))
+	for i, path := range seg {
+		stat, e := os.Stat(path)
+		if e != nil {
+			continue
+		}
+		info[i] = stat
+		total += stat.Size()
+	}
+
+	now := time.Now()
+	for i, path := range seg {
+		if info[i] == nil {
+			continue
+		}
+
+		expired := s.maxAge > 0 && now.Sub(info[i].ModTime()) > s.maxAge
+		full := s.maxSize > 0 && total > s.maxSize
+		if !expired && !full {
+			continue
+		}
+
+		if e := os.Remove(path); e != nil {
+			xEnv.Errorf("elastic spool remove %s fail %v", path, e)
+			continue
+		}
+		total -= info[i].Size()
+		xEnv.Errorf("elastic spool drop segment %s expired=%v full=%v", path, expired, full)
+	}
+}
+
+// replay 按顺序读取分段 每size条调用一次fn 分段结尾不足size条也调用
+// fn 返回false时停止 该分段保留下次重放(至少一次)
+func (s *spool) replay(size int, fn func([]*doc) bool) error {
+	seg, err := s.sealed()
+	if err != nil {
+		return err
+	}
+
+	if size <= 0 {
+		size = 1
+	}
+
+	for _, path := range seg {
+		fd, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		ok := true
+		var batch []*doc
+		scanner := bufio.NewScanner(fd)
+		scanner.Buffer(make([]byte, 64*1024), 64<<20)
+		for scanner.Scan() {
+			var r record
+			if e := json.Unmarshal(scanner.Bytes(), &r); e != nil {
+				xEnv.Errorf("elastic spool %s invalid record %v", path, e)
+				continue
+			}
+
+			if batch = append(batch, r.doc()); len(batch) < size {
+				continue
+			}
+
+			if ok = fn(batch); !ok {
+				break
+			}
+			batch = nil
+		}
+		err = scanner.Err()
+		fd.Close()
+
+		if ok && err == nil && len(batch) > 0 {
+			ok = fn(batch)
+		}
+
+		if !ok {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seal()
+}
+
+// spill 写入磁盘缓存 未开启或写入失败时按失败处理
+func (c *Client) spill(v ...*doc) {
+	if c.spool == nil {
+		for _, d := range v {
+			c.reject(&failure{doc: d, kind: "queue_overflow", reason: "spool disabled"})
+		}
+		return
+	}
+
+	for _, d := range v {
+		d.attempt = 0
+	}
+
+	if err := c.spool.push(v...); err != nil {
+		for _, d := range v {
+			c.reject(&failure{doc: d, kind: "spool_error", reason: err.Error()})
+		}
+		return
+	}
+	atomic.AddUint64(&c.spooled, uint64(len(v)))
+}
+
+// healthy 探测集群状态 非red时才开始回放
+func (c *Client) healthy(ctx context.Context, cli *elastic.Client) bool {
+	if cli == nil {
+		return false
+	}
+
+	rsp, err := cli.ClusterHealth().Do(ctx)
+	if err != nil {
+		return false
+	}
+	return rsp.Status != "red"
+}
+
+func (c *Client) probe(ctx context.Context) (*elastic.Client, error) {
+	if c.cfg.Default {
+		return EsApiClient()
+	}
+
+	opt, err := c.cfg.OptionsFunc()
+	if err != nil {
+		return nil, err
+	}
+	return elastic.DialContext(ctx, opt...)
+}
+
+// replay 集群恢复后按顺序回放磁盘缓存 ctx在关闭时取消
+func (c *Client) replay(ctx context.Context) {
+	defer c.wg.Done()
+
+	tk := time.NewTicker(spoolInterval)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-tk.C:
+			c.spool.trim()
+			c.drain(ctx)
+		}
+	}
+}
+
+/*
+	drain 不经过c.queue 由回放goroutine按分段顺序逐批同步发送
+	多个线程各自flush会打乱顺序 同一个_id的delete可能先于upsert写入
+	没有待回放的数据时不封存分段也不创建客户端
+*/
+
+func (c *Client) drain(ctx context.Context) {
+	if !c.spool.pending() {
+		return
+	}
+
+	cli, err := c.probe(ctx)
+	if err != nil {
+		return
+	}
+	defer cli.Stop()
+
+	if !c.healthy(ctx, cli) {
+		return
+	}
+
+	err = c.spool.replay(c.cfg.Flush, func(v []*doc) bool {
+		if !c.deliver(ctx, cli, v) {
+			return false
+		}
+		atomic.AddUint64(&c.replayed, uint64(len(v)))
+		return true
+	})
+
+	if err != nil {
+		xEnv.Errorf("%s spool replay fail %v", c.cfg.name(), err)
+	}
+}
+
+// deliver 发送一批回放的文档 超过重试次数或关闭时返回false
+func (c *Client) deliver(ctx context.Context, cli *elastic.Client, v []*doc) bool {
+	for _, d := range v {
+		d.replay = true
+	}
+
+	for attempt := 0; len(v) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > c.cfg.Retry {
+				return false
+			}
+
+			tm := time.NewTimer(c.cfg.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				tm.Stop()
+				return false
+			case <-tm.C:
+			}
+		}
+
+		v, _ = c.send(ctx, v, cli)
+	}
+	return true
+}
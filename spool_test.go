@@ -0,0 +1,99 @@
+package elastic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func newTestSpool(t *testing.T) *spool {
+	t.Helper()
+
+	s, err := newSpool(&config{Spool: t.TempDir(), SpoolSegment: 16})
+	if err != nil {
+		t.Fatalf("spool open fail %v", err)
+	}
+	t.Cleanup(func() { s.close() })
+	return s
+}
+
+func spoolIDs(v []*doc) []string {
+	var ids []string
+	for _, d := range v {
+		ids = append(ids, d.id)
+	}
+	return ids
+}
+
+func TestSpoolReplayOrder(t *testing.T) {
+	s := newTestSpool(t)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		if err := s.push(&doc{index: "app", id: id, op: OpIndex, data: map[string]interface{}{"n": id}}); err != nil {
+			t.Fatalf("spool push fail %v", err)
+		}
+	}
+
+	//检查是否有数据时不封存正在写入的分段
+	if !s.pending() {
+		t.Fatalf("spool pending = false want true")
+	}
+
+	if seg, _ := s.frozen(); len(seg) != 0 {
+		t.Fatalf("spool pending sealed the active segment %v", seg)
+	}
+
+	var got [][]string
+	err := s.replay(2, func(v []*doc) bool {
+		got = append(got, spoolIDs(v))
+		return true
+	})
+	if err != nil {
+		t.Fatalf("spool replay fail %v", err)
+	}
+
+	want := [][]string{{"1", "2"}, {"3", "4"}, {"5"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("spool replay batches = %v want %v", got, want)
+	}
+
+	if s.pending() {
+		t.Errorf("spool pending after replay")
+	}
+}
+
+func TestSpoolReplayKeep(t *testing.T) {
+	s := newTestSpool(t)
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := s.push(&doc{index: "app", id: id, data: map[string]interface{}{}}); err != nil {
+			t.Fatalf("spool push fail %v", err)
+		}
+	}
+
+	//第二批失败 整个分段保留
+	calls := 0
+	err := s.replay(2, func(v []*doc) bool {
+		calls++
+		return calls == 1
+	})
+	if err != nil {
+		t.Fatalf("spool replay fail %v", err)
+	}
+
+	if !s.pending() {
+		t.Fatalf("spool dropped a segment with an unsent batch")
+	}
+
+	var got []string
+	err = s.replay(10, func(v []*doc) bool {
+		got = append(got, spoolIDs(v)...)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("spool replay fail %v", err)
+	}
+
+	if want := []string{"1", "2", "3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("spool replay again = %v want %v", got, want)
+	}
+}
@@ -0,0 +1,267 @@
+package elastic
+
+import (
+	"github.com/vela-ssoc/vela-kit/lua"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const latencySamples = 1024
+
+// latency 保存最近的bulk耗时 用来计算分位数
+type latency struct {
+	mu   sync.Mutex
+	ring []time.Duration
+	pos  int
+}
+
+func (l *latency) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.ring) < latencySamples {
+		l.ring = append(l.ring, d)
+		return
+	}
+
+	l.ring[l.pos] = d
+	l.pos = (l.pos + 1) % latencySamples
+}
+
+func (l *latency) samples() []time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v := make([]time.Duration, len(l.ring))
+	copy(v, l.ring)
+	return v
+}
+
+type Percentile struct {
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+func percentile(v []time.Duration) Percentile {
+	n := len(v)
+	if n == 0 {
+		return Percentile{}
+	}
+
+	sort.Slice(v, func(i, j int) bool { return v[i] < v[j] })
+	at := func(p int) time.Duration {
+		return v[(n-1)*p/100]
+	}
+
+	return Percentile{P50: at(50), P90: at(90), P99: at(99)}
+}
+
+type ThreadStats struct {
+	ID        int
+	Accepted  uint64
+	Buffered  int64
+	Bulks     uint64
+	Bytes     uint64
+	Retries   uint64
+	RetryWait time.Duration
+	Latency   Percentile
+}
+
+type Stats struct {
+	Received    uint64
+	Denoised    uint64
+	Dropped     uint64
+	Queued      uint64
+	Sent        uint64
+	Failed      uint64
+	Retried     uint64
+	Bytes       uint64
+	Spooled     uint64
+	Replayed    uint64
+	Duplicated  uint64
+	DropTimeout uint64
+	DropNewest  uint64
+	DropOldest  uint64
+	DropClosed  uint64
+	Spilled     uint64
+	Retries     uint64
+	RetryWait   time.Duration
+	Depth       int
+	Capacity    int
+	Latency     Percentile
+	LastError   string
+	LastErrorAt time.Time
+	Conflicts   map[string]uint64
+	GeoHit      uint64
+	GeoMiss     uint64
+	Enrich      []EnrichStats
+	Lookup      []LookupStats
+	Threads     []ThreadStats
+}
+
+func (th *Thread) Stats() ThreadStats {
+	return ThreadStats{
+		ID:        th.ID,
+		Accepted:  atomic.LoadUint64(&th.count),
+		Buffered:  atomic.LoadInt64(&th.buffered),
+		Bulks:     atomic.LoadUint64(&th.bulks),
+		Bytes:     atomic.LoadUint64(&th.traffic),
+		Retries:   atomic.LoadUint64(&th.retries),
+		RetryWait: time.Duration(atomic.LoadInt64(&th.waited)),
+		Latency:   percentile(th.latency.samples()),
+	}
+}
+
+func (c *Client) setErr(err error) {
+	c.emu.Lock()
+	c.err = err
+	c.lastE = time.Now()
+	c.emu.Unlock()
+}
+
+// Stats 当前客户端和各线程的运行统计
+func (c *Client) Stats() *Stats {
+	s := &Stats{
+		Received:    atomic.LoadUint64(&c.received),
+		Denoised:    atomic.LoadUint64(&c.denoised),
+		Dropped:     atomic.LoadUint64(&c.dropped),
+		Queued:      atomic.LoadUint64(&c.queued),
+		Sent:        atomic.LoadUint64(&c.succeed),
+		Failed:      atomic.LoadUint64(&c.failed),
+		Retried:     atomic.LoadUint64(&c.retried),
+		Spooled:     atomic.LoadUint64(&c.spooled),
+		Replayed:    atomic.LoadUint64(&c.replayed),
+		Duplicated:  atomic.LoadUint64(&c.duplicated),
+		DropTimeout: atomic.LoadUint64(&c.dropTimeout),
+		DropNewest:  atomic.LoadUint64(&c.dropNewest),
+		DropOldest:  atomic.LoadUint64(&c.dropOldest),
+		DropClosed:  atomic.LoadUint64(&c.dropClosed),
+		Spilled:     atomic.LoadUint64(&c.spilled),
+		Depth:       len(c.queue),
+		Capacity:    cap(c.queue),
+		Conflicts:   c.Conflicts(),
+	}
+
+	if geo := c.geoStage(); geo != nil {
+		s.GeoHit = atomic.LoadUint64(&geo.hit)
+		s.GeoMiss = atomic.LoadUint64(&geo.miss)
+	}
+
+	for _, e := range c.enrichStages() {
+		s.Enrich = append(s.Enrich, e.Stats())
+	}
+
+	for _, lk := range c.lookupStages() {
+		s.Lookup = append(s.Lookup, lk.Stats())
+	}
+
+	c.emu.Lock()
+	if c.err != nil {
+		s.LastError = c.err.Error()
+		s.LastErrorAt = c.lastE
+	}
+	c.emu.Unlock()
+
+	var all []time.Duration
+	for _, th := range c.threads {
+		ts := th.Stats()
+		s.Bytes += ts.Bytes
+		s.Retries += ts.Retries
+		s.RetryWait += ts.RetryWait
+		s.Threads = append(s.Threads, ts)
+		all = append(all, th.latency.samples()...)
+	}
+	s.Latency = percentile(all)
+
+	return s
+}
+
+func ms(d time.Duration) lua.LNumber {
+	return lua.LNumber(float64(d) / float64(time.Millisecond))
+}
+
+func (p Percentile) table(L *lua.LState) *lua.LTable {
+	tab := L.NewTable()
+	tab.RawSetString("p50", ms(p.P50))
+	tab.RawSetString("p90", ms(p.P90))
+	tab.RawSetString("p99", ms(p.P99))
+	return tab
+}
+
+func (ts ThreadStats) table(L *lua.LState) *lua.LTable {
+	tab := L.NewTable()
+	tab.RawSetString("id", lua.LInt(ts.ID))
+	tab.RawSetString("accepted", lua.LNumber(ts.Accepted))
+	tab.RawSetString("buffered", lua.LNumber(ts.Buffered))
+	tab.RawSetString("bulks", lua.LNumber(ts.Bulks))
+	tab.RawSetString("bytes", lua.LNumber(ts.Bytes))
+	tab.RawSetString("retries", lua.LNumber(ts.Retries))
+	tab.RawSetString("retry_wait", ms(ts.RetryWait))
+	tab.RawSetString("latency", ts.Latency.table(L))
+	return tab
+}
+
+func (s *Stats) table(L *lua.LState) *lua.LTable {
+	tab := L.NewTable()
+	tab.RawSetString("received", lua.LNumber(s.Received))
+	tab.RawSetString("denoised", lua.LNumber(s.Denoised))
+	tab.RawSetString("dropped", lua.LNumber(s.Dropped))
+	tab.RawSetString("queued", lua.LNumber(s.Queued))
+	tab.RawSetString("sent", lua.LNumber(s.Sent))
+	tab.RawSetString("failed", lua.LNumber(s.Failed))
+	tab.RawSetString("retried", lua.LNumber(s.Retried))
+	tab.RawSetString("bytes", lua.LNumber(s.Bytes))
+	tab.RawSetString("spooled", lua.LNumber(s.Spooled))
+	tab.RawSetString("replayed", lua.LNumber(s.Replayed))
+	tab.RawSetString("duplicated", lua.LNumber(s.Duplicated))
+	tab.RawSetString("drop_timeout", lua.LNumber(s.DropTimeout))
+	tab.RawSetString("drop_newest", lua.LNumber(s.DropNewest))
+	tab.RawSetString("drop_oldest", lua.LNumber(s.DropOldest))
+	tab.RawSetString("drop_closed", lua.LNumber(s.DropClosed))
+	tab.RawSetString("spilled", lua.LNumber(s.Spilled))
+	tab.RawSetString("retries", lua.LNumber(s.Retries))
+	tab.RawSetString("retry_wait", ms(s.RetryWait))
+	tab.RawSetString("depth", lua.LInt(s.Depth))
+	tab.RawSetString("capacity", lua.LInt(s.Capacity))
+	tab.RawSetString("latency", s.Latency.table(L))
+	tab.RawSetString("last_error", lua.S2L(s.LastError))
+	if !s.LastErrorAt.IsZero() {
+		tab.RawSetString("last_error_at", lua.S2L(s.LastErrorAt.Format(time.RFC3339)))
+	}
+
+	tab.RawSetString("geoip_hit", lua.LNumber(s.GeoHit))
+	tab.RawSetString("geoip_miss", lua.LNumber(s.GeoMiss))
+
+	lookups := L.NewTable()
+	for i, es := range s.Enrich {
+		lookups.RawSetInt(i+1, es.table(L))
+	}
+	tab.RawSetString("enrich", lookups)
+
+	indices := L.NewTable()
+	for i, ls := range s.Lookup {
+		indices.RawSetInt(i+1, ls.table(L))
+	}
+	tab.RawSetString("lookup", indices)
+
+	conflicts := L.NewTable()
+	for field, n := range s.Conflicts {
+		conflicts.RawSetString(field, lua.LNumber(n))
+	}
+	tab.RawSetString("conflicts", conflicts)
+
+	threads := L.NewTable()
+	for i, ts := range s.Threads {
+		threads.RawSetInt(i+1, ts.table(L))
+	}
+	tab.RawSetString("threads", threads)
+	return tab
+}
+
+func (c *Client) statsL(L *lua.LState) int {
+	L.Push(c.Stats().table(L))
+	return 1
+}
@@ -3,19 +3,31 @@ package elastic
 import (
 	"github.com/olivere/elastic/v7"
 	"golang.org/x/net/context"
+	"net/http"
+	"sync/atomic"
 	"time"
 )
 
-type Handler func([]elastic.BulkableRequest, *elastic.Client) error
+// Handler 发送一批文档 返回需要重发的文档
+type Handler func([]*doc, *elastic.Client) ([]*doc, error)
 
 type Thread struct {
 	ID     int
 	cfg    *config
 	ctx    context.Context
-	count  int
+	count  uint64
 	handle Handler
 	cli    *elastic.Client
-	bucket []elastic.BulkableRequest
+	after  *retryAfter
+	bucket []*doc
+	bytes  int
+
+	retries  uint64
+	waited   int64
+	buffered int64
+	bulks    uint64
+	traffic  uint64
+	latency  latency
 }
 
 func NewThread(ctx context.Context, id int, cfg *config, hd Handler) *Thread {
@@ -47,7 +59,10 @@ func (th *Thread) Default() {
 */
 
 func (th *Thread) constructor() {
-	opt, err := th.cfg.OptionsFunc()
+	opt, err := th.cfg.OptionsFunc(func(rt http.RoundTripper) http.RoundTripper {
+		th.after = newRetryAfter(rt)
+		return th.after
+	})
 	if err != nil {
 		xEnv.Errorf("%s elastic thread.id=%d client invalid option %v", th.cfg.name(), th.ID, err)
 		return
@@ -67,26 +82,61 @@ func (th *Thread) Send() {
 		return
 	}
 
-	err := th.handle(th.bucket, th.cli)
-	if err != nil {
-		xEnv.Errorf("thread cap=%d len=%d send fail %v", cap(th.bucket), len(th.bucket), err)
+	batch := th.bucket
+	for attempt := 0; len(batch) > 0; attempt++ {
+		size := 0
+		for _, d := range batch {
+			size += d.size()
+		}
+
+		start := time.Now()
+		retry, err := th.handle(batch, th.cli)
+		th.latency.add(time.Since(start))
+		atomic.AddUint64(&th.bulks, 1)
+		atomic.AddUint64(&th.traffic, uint64(size))
+
+		if err != nil {
+			xEnv.Errorf("thread cap=%d len=%d send fail %v", cap(th.bucket), len(batch), err)
+		}
+
+		batch = retry
+		if len(batch) == 0 {
+			break
+		}
+
+		atomic.AddUint64(&th.retries, 1)
+		if !th.sleep(th.wait(attempt, batch)) {
+			break
+		}
+	}
+
+	// 退出时只保留还未发送成功的文档
+	n := copy(th.bucket, batch)
+	th.bucket = th.bucket[:n]
+
+	th.bytes = 0
+	for _, d := range th.bucket {
+		th.bytes += d.size()
 	}
-	th.bucket = th.bucket[:0]
+	atomic.StoreInt64(&th.buffered, int64(n))
 
 }
 
-func (th *Thread) append(r *elastic.BulkIndexRequest) {
+func (th *Thread) append(r *doc) {
 	th.bucket = append(th.bucket, r)
-	th.count++
+	th.bytes += r.size()
+	atomic.AddUint64(&th.count, 1)
+	atomic.StoreInt64(&th.buffered, int64(len(th.bucket)))
 
-	if len(th.bucket) < th.cfg.Flush {
+	full := th.cfg.FlushBytes > 0 && th.bytes >= th.cfg.FlushBytes
+	if len(th.bucket) < th.cfg.Flush && !full {
 		return
 	}
 
 	th.Send()
 }
 
-func (th *Thread) Accept(bch chan *elastic.BulkIndexRequest) {
+func (th *Thread) Accept(bch chan *doc) {
 	tk := time.NewTicker(time.Duration(th.cfg.Interval) * time.Second)
 	defer func() {
 		tk.Stop()
@@ -100,7 +150,12 @@ func (th *Thread) Accept(bch chan *elastic.BulkIndexRequest) {
 		case <-th.ctx.Done():
 			xEnv.Errorf("%s elastic.thread=%d exit..", th.cfg.name(), th.ID)
 			return
-		case r := <-bch:
+		case r, ok := <-bch:
+			if !ok {
+				//队列已关闭并读完 发送剩余的缓冲
+				th.Send()
+				return
+			}
 			th.append(r)
 		case <-tk.C:
 			th.Send()
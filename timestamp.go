@@ -0,0 +1,213 @@
+package elastic
+
+import (
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"math"
+	"strconv"
+	"time"
+)
+
+/*
+	timestamp = {
+		field    = "time",                                   --事件时间字段 默认@timestamp
+		layout   = {"RFC3339" , "epoch_ms" , "2006-01-02 15:04:05"},
+		timezone = "Asia/Shanghai",                          --没有时区信息的格式使用 默认UTC
+		missing  = "now",                                    --缺失或无法解析 now:使用当前时间 drop:丢弃 tag:使用当前时间并打标签
+		original = "_timestamp_original",                    --tag时保留无法解析的原始值
+		ingested = "event.ingested",                         --入库时间字段 为空不写
+	}
+*/
+
+const (
+	TimestampNow  = "now"
+	TimestampDrop = "drop"
+	TimestampTag  = "tag"
+
+	timestampFailure  = "_timestamp_failure"
+	timestampOriginal = "_timestamp_original"
+)
+
+type timestampConfig struct {
+	Field    string
+	Layouts  []string
+	Zone     *time.Location
+	Missing  string
+	Original string
+	Ingested string
+}
+
+func newTimestampConfig() *timestampConfig {
+	return &timestampConfig{
+		Field:    "@timestamp",
+		Layouts:  []string{"RFC3339"},
+		Zone:     time.UTC,
+		Missing:  TimestampNow,
+		Original: timestampOriginal,
+		Ingested: "event.ingested",
+	}
+}
+
+func checkTimestampConfig(L *lua.LState, val lua.LValue) *timestampConfig {
+	tab, ok := val.(*lua.LTable)
+	if !ok {
+		L.RaiseError("invalid timestamp , got %s", val.Type().String())
+		return nil
+	}
+
+	tc := newTimestampConfig()
+	tab.Range(func(key string, v lua.LValue) {
+		switch key {
+		case "field":
+			tc.Field = v.String()
+		case "layout":
+			switch v.Type() {
+			case lua.LTString:
+				tc.Layouts = []string{v.String()}
+			case lua.LTTable:
+				tc.Layouts = auxlib.LTab2SS(v.(*lua.LTable))
+			default:
+				L.RaiseError("invalid timestamp layout , got %s", v.Type().String())
+			}
+		case "timezone":
+			loc, err := time.LoadLocation(v.String())
+			if err != nil {
+				L.RaiseError("invalid timestamp timezone %v", err)
+				return
+			}
+			tc.Zone = loc
+		case "missing":
+			switch m := v.String(); m {
+			case TimestampNow, TimestampDrop, TimestampTag:
+				tc.Missing = m
+			default:
+				L.RaiseError("invalid timestamp missing , got %s", m)
+			}
+		case "original":
+			tc.Original = v.String()
+		case "ingested":
+			tc.Ingested = v.String()
+		}
+	})
+
+	return tc
+}
+
+func epoch(n float64, layout string) time.Time {
+	switch layout {
+	case "epoch_s", "unix":
+		sec, frac := math.Modf(n)
+		return time.Unix(int64(sec), int64(frac*1e9))
+	case "epoch_ms", "unix_ms":
+		return time.UnixMilli(int64(n))
+	case "epoch_us", "unix_us":
+		return time.UnixMicro(int64(n))
+	default:
+		return time.Unix(0, int64(n))
+	}
+}
+
+func isEpoch(layout string) bool {
+	switch layout {
+	case "epoch_s", "unix", "epoch_ms", "unix_ms", "epoch_us", "unix_us", "epoch_ns", "unix_ns":
+		return true
+	}
+	return false
+}
+
+func goLayout(layout string) string {
+	switch layout {
+	case "RFC3339":
+		return time.RFC3339Nano
+	case "RFC1123":
+		return time.RFC1123
+	case "RFC1123Z":
+		return time.RFC1123Z
+	case "RFC822":
+		return time.RFC822
+	case "RFC822Z":
+		return time.RFC822Z
+	case "Stamp":
+		return time.Stamp
+	case "DateTime":
+		return "2006-01-02 15:04:05"
+	}
+	return layout
+}
+
+// parse 按配置的格式依次尝试
+func (tc *timestampConfig) parse(v interface{}) (time.Time, bool) {
+	switch ts := v.(type) {
+	case time.Time:
+		return ts, !ts.IsZero()
+
+	case float64:
+		for _, layout := range tc.Layouts {
+			if isEpoch(layout) {
+				return epoch(ts, layout), true
+			}
+		}
+
+	case string:
+		for _, layout := range tc.Layouts {
+			if isEpoch(layout) {
+				n, err := strconv.ParseFloat(ts, 64)
+				if err != nil {
+					continue
+				}
+				return epoch(n, layout), true
+			}
+
+			t, err := time.ParseInLocation(goLayout(layout), ts, tc.Zone)
+			if err == nil {
+				return t, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func tag(d *doc, v string) {
+	switch tags := d.data["tags"].(type) {
+	case []interface{}:
+		d.data["tags"] = append(tags, v)
+	case string:
+		d.data["tags"] = []interface{}{tags, v}
+	default:
+		d.data["tags"] = []interface{}{v}
+	}
+}
+
+// DoTimestamp 保留事件时间 返回true表示丢弃
+func (c *Client) DoTimestamp(d *doc) bool {
+	tc := c.cfg.Timestamp
+	now := time.Now()
+	d.loc = c.cfg.IndexZone
+
+	if tc.Ingested != "" {
+		d.data[tc.Ingested] = now
+	}
+
+	raw := d.data[tc.Field]
+	if t, ok := tc.parse(raw); ok {
+		d.ts = t
+		d.data["@timestamp"] = t
+		return false
+	}
+
+	switch tc.Missing {
+	case TimestampDrop:
+		return true
+	case TimestampTag:
+		//@timestamp会被替换成当前时间 原始值另外保存
+		if raw != nil && tc.Original != "" {
+			d.data[tc.Original] = raw
+		}
+		tag(d, timestampFailure)
+	}
+
+	d.ts = now
+	d.data["@timestamp"] = now
+	return false
+}
@@ -0,0 +1,442 @@
+package elastic
+
+import (
+	"fmt"
+	cond "github.com/vela-ssoc/vela-cond"
+	"github.com/vela-ssoc/vela-kit/auxlib"
+	"github.com/vela-ssoc/vela-kit/lua"
+	"github.com/vela-ssoc/vela-kit/strutil"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	入队前按声明顺序改写文档 每个操作可以带cond 只在条件匹配时执行
+	字段支持 a.b.c 的嵌套路径
+
+	cli.transform(
+		{rename = "src_ip" , to = "source.ip"},
+		{remove = {"password" , "token"}},
+		{copy = "host" , to = "observer.hostname"},
+		{set = "env" , value = "prod" , cond = "app = nginx"},
+		{set = "id" , template = "$host-$pid"},
+		{convert = "pid" , type = "int"},
+		{lowercase = "host"},
+		{split = "tags" , sep = ","},
+		{flatten = "labels" , sep = "."},
+		{unflatten = true}
+	)
+*/
+
+const (
+	ConvertInt    = "int"
+	ConvertFloat  = "float"
+	ConvertBool   = "bool"
+	ConvertIP     = "ip"
+	ConvertString = "string"
+)
+
+type transform struct {
+	name string
+	cnd  *cond.Cond
+	fn   func(*doc) error
+}
+
+// get 按完整key或者'.'路径取值
+func (d *doc) get(path string) (interface{}, bool) {
+	m, key, ok := lookup(d.data, path)
+	if !ok {
+		return nil, false
+	}
+	return m[key], true
+}
+
+// set 已存在的完整key直接覆盖 否则按'.'路径逐级创建
+func (d *doc) set(path string, v interface{}) {
+	if m, key, ok := lookup(d.data, path); ok {
+		m[key] = v
+		return
+	}
+
+	m := d.data
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := m[part].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[part] = sub
+		}
+		m = sub
+	}
+	m[parts[len(parts)-1]] = v
+}
+
+func (d *doc) remove(path string) (interface{}, bool) {
+	m, key, ok := lookup(d.data, path)
+	if !ok {
+		return nil, false
+	}
+
+	v := m[key]
+	delete(m, key)
+	return v, true
+}
+
+func convert(v interface{}, typ string) (interface{}, error) {
+	switch typ {
+	case ConvertString:
+		return strutil.String(v), nil
+
+	case ConvertInt:
+		switch item := v.(type) {
+		case float64:
+			return int64(item), nil
+		case bool:
+			if item {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		}
+
+		s := strings.TrimSpace(strutil.String(v))
+		if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("convert %s to int fail", s)
+		}
+		return int64(math.Trunc(f)), nil
+
+	case ConvertFloat:
+		if f, ok := v.(float64); ok {
+			return f, nil
+		}
+
+		s := strings.TrimSpace(strutil.String(v))
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("convert %s to float fail", s)
+		}
+		return f, nil
+
+	case ConvertBool:
+		switch item := v.(type) {
+		case bool:
+			return item, nil
+		case float64:
+			return item != 0, nil
+		}
+
+		s := strings.TrimSpace(strutil.String(v))
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("convert %s to bool fail", s)
+		}
+		return b, nil
+
+	case ConvertIP:
+		s := strings.TrimSpace(strutil.String(v))
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("convert %s to ip fail", s)
+		}
+		return ip.String(), nil
+	}
+
+	return nil, fmt.Errorf("invalid convert type %s", typ)
+}
+
+func flattenMap(prefix, sep string, m map[string]interface{}, out map[string]interface{}) {
+	for key, val := range m {
+		path := key
+		if prefix != "" {
+			path = prefix + sep + key
+		}
+
+		if sub, ok := val.(map[string]interface{}); ok && len(sub) > 0 {
+			flattenMap(path, sep, sub, out)
+			continue
+		}
+		out[path] = val
+	}
+}
+
+func unflattenMap(sep string, m map[string]interface{}) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		if strings.Contains(key, sep) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := m[key]
+		delete(m, key)
+
+		cur := m
+		parts := strings.Split(key, sep)
+		for _, part := range parts[:len(parts)-1] {
+			sub, ok := cur[part].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				cur[part] = sub
+			}
+			cur = sub
+		}
+		cur[parts[len(parts)-1]] = val
+	}
+
+	for _, val := range m {
+		if sub, ok := val.(map[string]interface{}); ok {
+			unflattenMap(sep, sub)
+		}
+	}
+}
+
+// scope flatten unflatten的作用范围 true或空字符串表示整个文档
+func scope(d *doc, v lua.LValue) (map[string]interface{}, bool) {
+	if v.Type() == lua.LTBool || v.String() == "" {
+		return d.data, true
+	}
+
+	val, ok := d.get(v.String())
+	if !ok {
+		return nil, false
+	}
+
+	m, ok := val.(map[string]interface{})
+	return m, ok
+}
+
+func checkCond(L *lua.LState, v lua.LValue) *cond.Cond {
+	switch v.Type() {
+	case lua.LTString:
+		return cond.New(v.String())
+	case lua.LTTable:
+		return cond.New(auxlib.LTab2SS(v.(*lua.LTable))...)
+	}
+
+	L.RaiseError("invalid transform cond , got %s", v.Type().String())
+	return nil
+}
+
+func checkFields(v lua.LValue) []string {
+	if tab, ok := v.(*lua.LTable); ok {
+		return auxlib.LTab2SS(tab)
+	}
+	return []string{v.String()}
+}
+
+func newTransform(L *lua.LState, tab *lua.LTable) *transform {
+	t := &transform{}
+	to := ""
+	if v := tab.RawGetString("to"); v.Type() == lua.LTString {
+		to = v.String()
+	}
+	sep := ""
+	if v := tab.RawGetString("sep"); v.Type() != lua.LTNil {
+		sep = v.String()
+	}
+
+	tab.Range(func(key string, val lua.LValue) {
+		switch key {
+		case "cond":
+			t.cnd = checkCond(L, val)
+
+		case "rename":
+			t.name = key
+			field := val.String()
+			t.fn = func(d *doc) error {
+				v, ok := d.remove(field)
+				if ok {
+					d.set(to, v)
+				}
+				return nil
+			}
+
+		case "copy":
+			t.name = key
+			field := val.String()
+			t.fn = func(d *doc) error {
+				v, ok := d.get(field)
+				if ok {
+					d.set(to, v)
+				}
+				return nil
+			}
+
+		case "remove":
+			t.name = key
+			fields := checkFields(val)
+			t.fn = func(d *doc) error {
+				for _, field := range fields {
+					d.remove(field)
+				}
+				return nil
+			}
+
+		case "set":
+			t.name = key
+			field := val.String()
+			if tpl := tab.RawGetString("template"); tpl.Type() == lua.LTString {
+				render := fieldTemplate(tpl.String())
+				t.fn = func(d *doc) error {
+					v, err := render(d)
+					if err != nil {
+						return err
+					}
+					d.set(field, v)
+					return nil
+				}
+				return
+			}
+
+			value := luaValue(tab.RawGetString("value"))
+			t.fn = func(d *doc) error {
+				d.set(field, value)
+				return nil
+			}
+
+		case "convert":
+			t.name = key
+			field := val.String()
+			typ := tab.RawGetString("type").String()
+			switch typ {
+			case ConvertInt, ConvertFloat, ConvertBool, ConvertIP, ConvertString:
+			default:
+				L.RaiseError("transform convert %s invalid type %s", field, typ)
+				return
+			}
+
+			t.fn = func(d *doc) error {
+				v, ok := d.get(field)
+				if !ok || v == nil {
+					return nil
+				}
+
+				nv, err := convert(v, typ)
+				if err != nil {
+					return err
+				}
+				d.set(field, nv)
+				return nil
+			}
+
+		case "lowercase":
+			t.name = key
+			fields := checkFields(val)
+			t.fn = func(d *doc) error {
+				for _, field := range fields {
+					if s, ok := d.get(field); ok {
+						if str, isStr := s.(string); isStr {
+							d.set(field, strings.ToLower(str))
+						}
+					}
+				}
+				return nil
+			}
+
+		case "split":
+			t.name = key
+			field := val.String()
+			if sep == "" {
+				sep = ","
+			}
+
+			t.fn = func(d *doc) error {
+				v, ok := d.get(field)
+				if !ok {
+					return nil
+				}
+
+				s, ok := v.(string)
+				if !ok {
+					return nil
+				}
+
+				var arr []interface{}
+				for _, item := range strings.Split(s, sep) {
+					if item = strings.TrimSpace(item); item != "" {
+						arr = append(arr, item)
+					}
+				}
+				d.set(field, arr)
+				return nil
+			}
+
+		case "flatten":
+			t.name = key
+			if sep == "" {
+				sep = "."
+			}
+
+			t.fn = func(d *doc) error {
+				m, ok := scope(d, val)
+				if !ok {
+					return nil
+				}
+
+				flat := make(map[string]interface{})
+				flattenMap("", sep, m, flat)
+				for k := range m {
+					delete(m, k)
+				}
+				for k, v := range flat {
+					m[k] = v
+				}
+				return nil
+			}
+
+		case "unflatten":
+			t.name = key
+			if sep == "" {
+				sep = "."
+			}
+
+			t.fn = func(d *doc) error {
+				m, ok := scope(d, val)
+				if ok {
+					unflattenMap(sep, m)
+				}
+				return nil
+			}
+		}
+	})
+
+	if t.fn == nil {
+		L.RaiseError("transform need one of rename remove copy set convert lowercase split flatten unflatten")
+		return nil
+	}
+
+	if (t.name == "rename" || t.name == "copy") && to == "" {
+		L.RaiseError("transform %s need to", t.name)
+		return nil
+	}
+
+	return t
+}
+
+func (c *Client) DoTransform(d *doc) {
+	for _, t := range c.transforms {
+		if t.cnd != nil && !t.cnd.Match(d) {
+			continue
+		}
+
+		if err := t.fn(d); err != nil {
+			xEnv.Errorf("%s transform %s fail %v", c.cfg.name(), t.name, err)
+		}
+	}
+}
+
+func (c *Client) transformL(L *lua.LState) int {
+	n := L.GetTop()
+	for i := 1; i <= n; i++ {
+		c.transforms = append(c.transforms, newTransform(L, L.CheckTable(i)))
+	}
+	return 0
+}